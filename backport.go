@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// backportMarker is hidden in the comment left on a master PR once its
+// backport to relBranch was tried, so it is tried only once.
+func backportMarker(relBranch string) string {
+	return fmt.Sprintf("<!-- vsts-branch backport %s -->", relBranch)
+}
+
+func runBackport() {
+	failed := 0
+	for _, repo := range secret.repositories() {
+		if !backportPullRequests(repo) {
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		fmt.Printf("Backport failed in %v repositories.\n", failed)
+		os.Exit(1)
+	}
+}
+
+// latestReleaseBranch returns the newest release branch.
+func latestReleaseBranch(client *http.Client, repo repoConfig) string {
+	branches := releaseBranches(client, repo)
+	if len(branches) == 0 {
+		return ""
+	}
+	return branches[len(branches)-1]
+}
+
+// backportPullRequests cherry-picks completed master PRs carrying one of
+// the backportLabels into the release branch the label maps to. The
+// target "current" is the newest release branch.
+func backportPullRequests(repo repoConfig) bool {
+	if len(repo.BackportLabels) == 0 {
+		fmt.Printf("%s: no backportLabels configured.\n", repo.Repo)
+		return true
+	}
+
+	client := &http.Client{}
+	current := latestReleaseBranch(client, repo)
+	fmt.Printf("%s: current release branch: %s\n", repo.Repo, current)
+
+	succeeded := true
+	completed := searchPullRequests(client, repo, "Completed", repo.MasterBranch, "", 100)
+	for _, pr := range completed.Value {
+		for _, label := range getPullRequestLabels(client, repo, pr.PullRequestID).Value {
+			target, ok := repo.BackportLabels[label.Name]
+			if !ok || !label.Active {
+				continue
+			}
+			if target == "current" {
+				target = current
+			}
+			if target == "" {
+				fmt.Printf("No release branch to backport PR %v to.\n", pr.PullRequestID)
+				succeeded = false
+				continue
+			}
+
+			if !backportPullRequest(client, repo, pr, target) {
+				succeeded = false
+			}
+		}
+	}
+	return succeeded
+}
+
+func backportPullRequest(client *http.Client, repo repoConfig, pr gitPullRequest, relBranch string) bool {
+	marker := backportMarker(relBranch)
+	for _, thread := range getPullRequestThreads(client, repo, pr.PullRequestID).Value {
+		for _, c := range thread.Comments {
+			if strings.Contains(c.Content, marker) {
+				fmt.Printf("PR %v was already backported to %s.\n", pr.PullRequestID, relBranch)
+				return true
+			}
+		}
+	}
+
+	fmt.Printf("Backport PR %v to %s...\n", pr.PullRequestID, relBranch)
+	backportBranch := fmt.Sprintf("backport/%v-%s", pr.PullRequestID, relBranch)
+	cherryPick := cherryPickCommits(client, repo, relBranch, backportBranch, []string{pr.LastMergeCommit.CommitID})
+	if cherryPick.Status != "completed" {
+		reason := "Cherry-pick " + cherryPick.Status
+		if cherryPick.DetailedStatus.Conflict {
+			reason = "Cherry-pick has conflicts"
+		}
+		content := fmt.Sprintf("%s\n**Backport to %s failed.** %s. %s\n\nPlease backport this PR by hand.", marker, relBranch, reason, cherryPick.DetailedStatus.FailureMessage)
+		postPullRequestThread(client, repo, pr.PullRequestID, content, "active")
+		return false
+	}
+
+	title := fmt.Sprintf("[%s] %s", relBranch, pr.Title)
+	description := fmt.Sprintf("Backport of !%v to %s.\n\n%s", pr.PullRequestID, relBranch, pr.Description)
+	relVersion := ""
+	if relFile, err := getBranchVersionFile(client, repo, relBranch); err == nil {
+		if v, err := buildVersion(repo, relFile); err == nil {
+			relVersion = v.Value
+		}
+	}
+	options := withReleaseMessage(repo.PullRequestOptions["backport"], relVersion, relBranch)
+	// the backport tracks the work items of the original PR
+	options.WorkItems = append([]int{}, options.WorkItems...)
+	for _, workItem := range getPullRequestWorkItems(client, repo, pr.PullRequestID).Value {
+		if id, err := strconv.Atoi(workItem.ID); err == nil {
+			options.WorkItems = append(options.WorkItems, id)
+		}
+	}
+
+	backport, err := submitPullRequest(client, repo, backportBranch, relBranch, title, description, options)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return false
+	}
+
+	postStatus(client, repo, backport.PullRequestID, prStatus{
+		Action:    fmt.Sprintf("Backport !%v to %s", pr.PullRequestID, relBranch),
+		RelBranch: relBranch,
+		Commits:   []string{pr.LastMergeCommit.CommitID},
+	})
+
+	content := fmt.Sprintf("%s\nBackported to %s in !%v.", marker, relBranch, backport.PullRequestID)
+	postPullRequestThread(client, repo, pr.PullRequestID, content, "closed")
+
+	// auto-complete of the backport pullRequestOptions wins, the PR is
+	// then left to the service
+	if repo.BackportAutoComplete && !options.AutoComplete && !backport.IsDraft {
+		waitForMergeStatus(client, repo, backport.PullRequestID, 5*time.Minute)
+		diffs := getDiffsBetweenBranches(client, repo, relBranch, backportBranch)
+		options.DeleteSourceBranch = true
+		return finishPullRequest(client, repo, backport, diffs.TargetCommit, options)
+	}
+	return true
+}
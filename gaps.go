@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// patchBlobs holds the file contents diffed for patch ids.
+var patchBlobs = blobCache{blobs: map[string]*cachedBlob{}}
+
+var mergedPullRequestPattern = regexp.MustCompile(`^Merged PR (\d+):`)
+
+// gap is a commit on one side of a release branch fork which has no
+// equivalent on the other side.
+type gap struct {
+	Repo        string
+	Branch      string
+	MissingFrom string
+	CommitID    string
+	PullRequest string
+	Subject     string
+	// Truncated is set when the commit has too many changes for its
+	// patch id, it may still have an equivalent.
+	Truncated bool
+}
+
+// gapSummary counts the commits of one release branch and its master.
+type gapSummary struct {
+	Repo         string
+	Branch       string
+	AheadCount   int
+	BehindCount  int
+	Equivalents  int
+	MissingCount int
+}
+
+func runGapReport(format string, output string) {
+	if format != "markdown" && format != "csv" {
+		fmt.Printf("unknown report format %q, use markdown or csv\n", format)
+		os.Exit(2)
+	}
+
+	w := io.Writer(os.Stdout)
+	if output != "" && output != "-" {
+		file, err := os.Create(output)
+		if err != nil {
+			fmt.Printf("Error report: %v\n", err)
+			os.Exit(1)
+		}
+		defer file.Close()
+		w = file
+	}
+
+	summaries := []gapSummary{}
+	gaps := []gap{}
+	failed := 0
+	for _, repo := range secret.repositories() {
+		s, g, err := releaseGaps(repo)
+		if err != nil {
+			fmt.Printf("%s: Error gap report: %v\n", repo.Repo, err)
+			failed++
+		}
+		summaries = append(summaries, s...)
+		gaps = append(gaps, g...)
+	}
+
+	var err error
+	if format == "csv" {
+		err = writeGapCSV(w, gaps)
+	} else {
+		err = writeGapMarkdown(w, summaries, gaps)
+	}
+	if err != nil {
+		fmt.Printf("Error report: %v\n", err)
+		os.Exit(1)
+	}
+
+	if failed > 0 {
+		fmt.Printf("Gap report failed in %v repositories.\n", failed)
+		os.Exit(1)
+	}
+}
+
+// releaseGaps compares master with every release branch since their fork
+// point. Commits whose patch id matches a commit on the other side are
+// cherry-picks and not reported, nor are merge commits and version resets.
+func releaseGaps(repo repoConfig) ([]gapSummary, []gap, error) {
+	client := &http.Client{}
+	ctx := context.Background()
+
+	branches := releaseBranches(client, repo)
+	sort.Sort(sort.Reverse(sort.StringSlice(branches)))
+
+	summaries := []gapSummary{}
+	gaps := []gap{}
+	for _, relBranch := range branches {
+		fmt.Printf("%s: compare %s with %s\n", repo.Repo, relBranch, repo.MasterBranch)
+		diffs := getDiffsBetweenBranches(client, repo, repo.MasterBranch, relBranch)
+		summary := gapSummary{
+			Repo:        repo.Repo,
+			Branch:      relBranch,
+			AheadCount:  diffs.AheadCount,
+			BehindCount: diffs.BehindCount,
+		}
+
+		sides := []struct {
+			missingFrom string
+			commits     commits
+			others      commits
+		}{
+			{relBranch, getCommitsBetweenBranches(client, repo, relBranch, repo.MasterBranch), commits{}},
+			{repo.MasterBranch, getCommitsBetweenBranches(client, repo, repo.MasterBranch, relBranch), commits{}},
+		}
+		sides[0].others, sides[1].others = sides[1].commits, sides[0].commits
+
+		for _, side := range sides {
+			otherPatchIDs := map[string]bool{}
+			for _, c := range side.others.Value {
+				if len(c.Parents) > 1 {
+					continue
+				}
+				patchID, truncated, err := commitPatchID(ctx, client, repo, c.CommitID)
+				if err != nil {
+					return summaries, gaps, err
+				}
+				if !truncated {
+					otherPatchIDs[patchID] = true
+				}
+			}
+
+			for i := len(side.commits.Value) - 1; i >= 0; i-- {
+				c := side.commits.Value[i]
+				if len(c.Parents) > 1 || strings.HasPrefix(c.Comment, versionResetComment) {
+					continue
+				}
+				patchID, truncated, err := commitPatchID(ctx, client, repo, c.CommitID)
+				if err != nil {
+					return summaries, gaps, err
+				}
+				if !truncated && otherPatchIDs[patchID] {
+					summary.Equivalents++
+					continue
+				}
+
+				g := gap{
+					Repo:        repo.Repo,
+					Branch:      relBranch,
+					MissingFrom: side.missingFrom,
+					CommitID:    c.CommitID,
+					Subject:     strings.SplitN(c.Comment, "\n", 2)[0],
+					Truncated:   truncated,
+				}
+				if m := mergedPullRequestPattern.FindStringSubmatch(c.Comment); m != nil {
+					g.PullRequest = m[1]
+				}
+				gaps = append(gaps, g)
+				summary.MissingCount++
+			}
+		}
+		summaries = append(summaries, summary)
+	}
+	return summaries, gaps, nil
+}
+
+// commitPatchID hashes the lines a commit adds and removes per file,
+// ignoring whitespace and line numbers like git patch-id, so a
+// cherry-pick gets the id of its original. truncated is set when the
+// commit changes more files than getCommit lists, the id then covers only
+// some of them and must not be matched.
+func commitPatchID(ctx context.Context, client *http.Client, repo repoConfig, commitID string) (patchID string, truncated bool, err error) {
+	details := getCommit(client, repo, commitID)
+	truncated = details.changesTruncated()
+	changes := details.Changes
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Item.Path < changes[j].Item.Path })
+
+	h := sha1.New()
+	for _, change := range changes {
+		if change.Item.IsFolder || change.Item.GitObjectType == "tree" {
+			continue
+		}
+
+		oldID, newID := change.Item.OriginalObjectID, change.Item.ObjectID
+		switch {
+		case strings.Contains(change.ChangeType, "delete"):
+			oldID, newID = change.Item.ObjectID, ""
+		case strings.Contains(change.ChangeType, "add"):
+			oldID = ""
+		}
+
+		oldLines, err := blobLines(ctx, client, repo, oldID)
+		if err != nil {
+			return "", truncated, err
+		}
+		newLines, err := blobLines(ctx, client, repo, newID)
+		if err != nil {
+			return "", truncated, err
+		}
+
+		fmt.Fprintf(h, "%s\n", change.Item.Path)
+		for _, line := range lineChanges(oldLines, newLines, "-") {
+			fmt.Fprintln(h, line)
+		}
+		for _, line := range lineChanges(newLines, oldLines, "+") {
+			fmt.Fprintln(h, line)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), truncated, nil
+}
+
+func blobLines(ctx context.Context, client *http.Client, repo repoConfig, objectID string) ([]string, error) {
+	if objectID == "" || objectID == zeroObjectID {
+		return nil, nil
+	}
+	content, err := patchBlobs.get(ctx, client, repo, objectID)
+	if err != nil {
+		return nil, err
+	}
+
+	lines := []string{}
+	for _, line := range strings.Split(string(content), "\n") {
+		if line = strings.Join(strings.Fields(line), ""); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
+
+// lineChanges returns the lines of from which are not in to, counting
+// repeated lines, each prefixed with sign.
+func lineChanges(from []string, to []string, sign string) []string {
+	remaining := map[string]int{}
+	for _, line := range to {
+		remaining[line]++
+	}
+
+	changes := []string{}
+	for _, line := range from {
+		if remaining[line] > 0 {
+			remaining[line]--
+			continue
+		}
+		changes = append(changes, sign+line)
+	}
+	return changes
+}
+
+func writeGapCSV(w io.Writer, gaps []gap) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"repository", "release branch", "missing from", "commit", "pull request", "subject", "not compared"})
+	for _, g := range gaps {
+		notCompared := ""
+		if g.Truncated {
+			notCompared = fmt.Sprintf("more than %v changes", commitChangeCount)
+		}
+		cw.Write([]string{g.Repo, g.Branch, g.MissingFrom, g.CommitID, g.PullRequest, g.Subject, notCompared})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func writeGapMarkdown(w io.Writer, summaries []gapSummary, gaps []gap) error {
+	r := strings.NewReplacer("|", `\|`, "\n", " ")
+
+	fmt.Fprintln(w, "# Backport gap report")
+	for _, s := range summaries {
+		fmt.Fprintf(w, "\n## %s %s\n\n", s.Repo, s.Branch)
+		fmt.Fprintf(w, "%v commits only on the release branch, %v only on master, %v cherry-picked, %v missing.\n", s.AheadCount, s.BehindCount, s.Equivalents, s.MissingCount)
+		if s.MissingCount == 0 {
+			continue
+		}
+
+		fmt.Fprintln(w, "\n| Missing from | Commit | PR | Subject |")
+		fmt.Fprintln(w, "| --- | --- | --- | --- |")
+		for _, g := range gaps {
+			if g.Repo != s.Repo || g.Branch != s.Branch {
+				continue
+			}
+			pullRequest := ""
+			if g.PullRequest != "" {
+				pullRequest = "!" + g.PullRequest
+			}
+			subject := r.Replace(g.Subject)
+			if g.Truncated {
+				subject += fmt.Sprintf(" (more than %v changes, not compared)", commitChangeCount)
+			}
+			if _, err := fmt.Fprintf(w, "| %s | %s | %s | %s |\n", g.MissingFrom, g.CommitID, pullRequest, subject); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
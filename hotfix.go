@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var commitIDPattern = regexp.MustCompile(`^[0-9a-fA-F]{40}$`)
+
+// selectRepo returns the repository called name, or the only one
+// configured when name is empty.
+func selectRepo(name string) (repoConfig, bool) {
+	repos := secret.repositories()
+	if name == "" && len(repos) == 1 {
+		return repos[0], true
+	}
+	for _, repo := range repos {
+		if repo.Repo == name {
+			return repo, true
+		}
+	}
+	return repoConfig{}, false
+}
+
+// resolveCommits turns master commit ids and PR ids into the commits to
+// cherry-pick, a PR stands for its merge commit.
+func resolveCommits(client *http.Client, repo repoConfig, changes []string) ([]string, error) {
+	commitIDs := []string{}
+	for _, change := range changes {
+		if commitIDPattern.MatchString(change) {
+			commitIDs = append(commitIDs, change)
+			continue
+		}
+
+		pullRequestID, err := strconv.Atoi(strings.TrimPrefix(change, "!"))
+		if err != nil {
+			return nil, fmt.Errorf("%s is neither a commit id nor a PR id", change)
+		}
+
+		pullRequest := getPullRequest(client, repo, pullRequestID)
+		if pullRequest.Status != "completed" || pullRequest.LastMergeCommit.CommitID == "" {
+			return nil, fmt.Errorf("PR %v is not completed: %s", pullRequestID, pullRequest.Status)
+		}
+		fmt.Printf("PR %v merged as %s\n", pullRequestID, pullRequest.LastMergeCommit.CommitID)
+		commitIDs = append(commitIDs, pullRequest.LastMergeCommit.CommitID)
+	}
+	return commitIDs, nil
+}
+
+func runHotfix(repoName string, relBranch string, changes []string, mergeTimeout time.Duration) {
+	repo, ok := selectRepo(repoName)
+	if !ok {
+		fmt.Println("Use -repo to choose one of the configured repositories.")
+		os.Exit(2)
+	}
+
+	if !hotfixRelease(repo, relBranch, changes, mergeTimeout) {
+		os.Exit(1)
+	}
+}
+
+// hotfixRelease cherry-picks changes onto a topic branch of relBranch,
+// bumps the revision there and opens a PR into relBranch. Once the PR is
+// merged the release build is queued.
+func hotfixRelease(repo repoConfig, relBranch string, changes []string, mergeTimeout time.Duration) bool {
+	client := &http.Client{}
+
+	commitIDs, err := resolveCommits(client, repo, changes)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return false
+	}
+
+	scheme, err := newVersionScheme(repo, time.Now())
+	if err != nil {
+		fmt.Printf("Error version scheme: %v\n", err)
+		return false
+	}
+
+	// cherry-pick
+	topicBranch := fmt.Sprintf("hotfix/%s-%s", relBranch, time.Now().Format("20060102150405"))
+	cherryPick := cherryPickCommits(client, repo, relBranch, topicBranch, commitIDs)
+	if cherryPick.Status != "completed" {
+		fmt.Printf("Cherry-pick onto %s failed, conflict: %v, %s\n", relBranch, cherryPick.DetailedStatus.Conflict, cherryPick.DetailedStatus.FailureMessage)
+		return false
+	}
+
+	topicRef := ref{}
+	for _, b := range getRelBranches(client, repo, topicBranch).Value {
+		if b.Name == fmt.Sprintf("%s/%s", "refs/heads", topicBranch) {
+			topicRef = b
+		}
+	}
+	if topicRef.ObjectID == "" {
+		fmt.Printf("Branch %s not found after cherry-pick\n", topicBranch)
+		return false
+	}
+
+	// bump revision
+	versionFile, err := getCommitVersionFile(client, repo, topicRef.ObjectID)
+	if err != nil {
+		fmt.Printf("Error version file: %v\n", err)
+		return false
+	}
+	before, err := buildVersion(repo, versionFile)
+	if err != nil {
+		fmt.Printf("Error version file: %v\n", err)
+		return false
+	}
+	resets, err := resetVersions(repo, versionFile)
+	if err != nil {
+		fmt.Printf("Error version file: %v\n", err)
+		return false
+	}
+	for _, current := range resets {
+		value, err := scheme.NextRevision(current.Value)
+		if err != nil {
+			fmt.Printf("Error version file: %v\n", err)
+			return false
+		}
+		if err := versionFile.SetVersion(current.Name, value); err != nil {
+			fmt.Printf("Error version file: %v\n", err)
+			return false
+		}
+		fmt.Printf("Bump version %s to: %s\n", current.Name, value)
+	}
+	hotfixVersion, err := buildVersion(repo, versionFile)
+	if err != nil {
+		fmt.Printf("Error version file: %v\n", err)
+		return false
+	}
+
+	title := fmt.Sprintf("Hotfix %s for release %s", hotfixVersion.Value, relBranch)
+	if pushVersionFile(client, repo, versionFile, topicBranch, topicRef.ObjectID, title) == "" {
+		fmt.Printf("Failed to push version to %s\n", topicBranch)
+		return false
+	}
+
+	// PR into the release branch
+	description := fmt.Sprintf("Cherry-picked from %s:\n\n- %s", repo.MasterBranch, strings.Join(commitIDs, "\n- "))
+	created, err := submitPullRequest(client, repo, topicBranch, relBranch, title, description, withReleaseMessage(repo.PullRequestOptions["hotfix"], hotfixVersion.Value, relBranch))
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return false
+	}
+
+	pullRequestID := created.PullRequestID
+	status := prStatus{
+		Action:        "Hotfix " + relBranch,
+		RelBranch:     relBranch,
+		VersionBefore: before.Value,
+		VersionAfter:  hotfixVersion.Value,
+		Commits:       commitIDs,
+	}
+	postStatus(client, repo, pullRequestID, status)
+
+	fmt.Printf("Waiting up to %v for PR %v to merge...\n", mergeTimeout, pullRequestID)
+	pullRequest := waitForPullRequest(client, repo, pullRequestID, mergeTimeout)
+	if pullRequest.Status != "completed" {
+		fmt.Printf("PR %v is %s, release build not queued.\n", pullRequestID, pullRequest.Status)
+		return false
+	}
+
+	status.BuildID = queueReleaseBuild(client, repo, relBranch)
+	postStatus(client, repo, pullRequestID, status)
+	return status.BuildID != 0
+}
+
+// queueReleaseBuild queues a build of relBranch with its release build
+// definition and returns the build id, 0 if none was queued.
+func queueReleaseBuild(client *http.Client, repo repoConfig, relBranch string) int {
+	defs := getBuildDefinitions(client, repo, relBranch)
+	if defs.Count < 1 {
+		fmt.Printf("No build definition for %s\n", relBranch)
+		return 0
+	}
+
+	buildDefID := defs.Value[0].ID
+	for _, def := range defs.Value {
+		if def.Name == repo.DefinitionName {
+			buildDefID = def.ID
+			break
+		}
+	}
+
+	return postBuild(client, relBranch, buildDefID)
+}
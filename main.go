@@ -2,38 +2,103 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
-	"encoding/xml"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
+type repoConfig struct {
+	Repo                string            `json:"repo"`
+	MasterBranch        string            `json:"masterBranch"`
+	ReleaseBranchPrefix string            `json:"releaseBranchPrefix"`
+	VersionPath         string            `json:"versionPath"`
+	VersionFormat       string            `json:"versionFormat"`
+	BuildVersionName    string            `json:"buildVersionName"`
+	ResetVersionNames   []string          `json:"resetVersionNames"`
+	VersionScheme       string            `json:"versionScheme"`
+	ResetDetection      string            `json:"resetDetection"`
+	HistoryScanWorkers  int               `json:"historyScanWorkers"`
+	CreateReleaseTags   bool              `json:"createReleaseTags"`
+	ForkTagTemplate     string            `json:"forkTagTemplate"`
+	VersionTagTemplate  string            `json:"versionTagTemplate"`
+	BackportLabels      map[string]string `json:"backportLabels"`
+	// BackportAutoComplete completes backport PRs right away, unless
+	// pullRequestOptions["backport"] sets autoComplete
+	BackportAutoComplete     bool     `json:"backportAutoComplete"`
+	CalVerFormat             string   `json:"calVerFormat"`
+	BumpComponent            string   `json:"bumpComponent"`
+	ResetComponents          []string `json:"resetComponents"`
+	DefinitionPathPrefix     string   `json:"definitionPathPrefix"`
+	DefinitionName           string   `json:"definitionName"`
+	OnboardBuildDefinitionID int      `json:"onboardBuildDefinitionId"`
+	// OnboardRepositoryName is the GitRepositoryName the onboarding build
+	// is queued with, "Compute-CloudShell" if not set
+	OnboardRepositoryName string `json:"onboardRepositoryName"`
+	// options of the PRs opened for "version", "hotfix", "backport" and
+	// "mergeback"
+	PullRequestOptions map[string]pullRequestOptions `json:"pullRequestOptions"`
+	// RespectPolicies completes PRs only once their branch policies pass,
+	// instead of bypassing them.
+	RespectPolicies      bool `json:"respectPolicies"`
+	PolicyTimeoutMinutes int  `json:"policyTimeoutMinutes"`
+	// backoff of the wait for the onboarding build to create the build
+	// definition of a new release branch
+	DefinitionPollInitialSeconds int `json:"definitionPollInitialSeconds"`
+	DefinitionPollMaxSeconds     int `json:"definitionPollMaxSeconds"`
+	DefinitionPollTimeoutMinutes int `json:"definitionPollTimeoutMinutes"`
+	// SupersededPullRequests is what happens to active PRs into the
+	// previous release branch on a cut: "retarget", "abandon" or "report".
+	SupersededPullRequests string `json:"supersededPullRequests"`
+	// globs of the files brought from the release branch into the master
+	// version PR next to the version file, and of those it must not change
+	SyncAllowPaths []string `json:"syncAllowPaths"`
+	SyncDenyPaths  []string `json:"syncDenyPaths"`
+}
+
 type secrets struct {
-	Username                 string `json:"username"`
-	Password                 string `json:"password"`
-	Instance                 string `json:"instance"`
-	Collection               string `json:"collection"`
-	Project                  string `json:"project"`
-	Repo                     string `json:"repo"`
-	MasterBranch             string `json:"masterBranch"`
-	ReleaseBranchPrefix      string `json:"releaseBranchPrefix"`
-	VersionPath              string `json:"versionPath"`
-	DefinitionPathPrefix     string `json:"definitionPathPrefix"`
-	DefinitionName           string `json:"definitionName"`
-	OnboardBuildDefinitionID int    `json:"onboardBuildDefinitionId"`
+	Username   string `json:"username"`
+	Password   string `json:"password"`
+	Instance   string `json:"instance"`
+	Collection string `json:"collection"`
+	Project    string `json:"project"`
+	// single repository settings, kept for configs that predate "repos"
+	repoConfig
+	Repos                []repoConfig `json:"repos"`
+	MaxParallelRepos     int          `json:"maxParallelRepos"`
+	FailOnPartialFailure bool         `json:"failOnPartialFailure"`
+}
+
+// repositories returns the repositories to cut in this run.
+func (s secrets) repositories() []repoConfig {
+	if len(s.Repos) == 0 {
+		return []repoConfig{s.repoConfig}
+	}
+	return s.Repos
+}
+
+type cutResult struct {
+	Repo      string
+	Branch    string
+	Succeeded bool
 }
 
 type ref struct {
-	Name     string `json:"name"`
-	ObjectID string `json:"objectId"`
-	URL      string `json:"url"`
+	Name           string `json:"name"`
+	ObjectID       string `json:"objectId"`
+	PeeledObjectID string `json:"peeledObjectId"`
+	URL            string `json:"url"`
 }
 
 type refs struct {
@@ -47,11 +112,61 @@ type branch struct {
 	NewObjectID string `json:"newObjectId"`
 }
 
+type refUpdateResults struct {
+	Value []struct {
+		Name         string `json:"name"`
+		OldObjectID  string `json:"oldObjectId"`
+		NewObjectID  string `json:"newObjectId"`
+		Success      bool   `json:"success"`
+		UpdateStatus string `json:"updateStatus"`
+	} `json:"value"`
+	Count int `json:"count"`
+}
+
+type gitCommitRef struct {
+	CommitID string `json:"commitId"`
+}
+
+type asyncRefOperationSource struct {
+	CommitList    []gitCommitRef `json:"commitList,omitempty"`
+	PullRequestID int            `json:"pullRequestId,omitempty"`
+}
+
+type cherryPickReq struct {
+	OntoRefName      string                  `json:"ontoRefName"`
+	GeneratedRefName string                  `json:"generatedRefName"`
+	Source           asyncRefOperationSource `json:"source"`
+}
+
+type cherryPick struct {
+	CherryPickID   int    `json:"cherryPickId"`
+	Status         string `json:"status"`
+	DetailedStatus struct {
+		Conflict        bool   `json:"conflict"`
+		CurrentCommitID string `json:"currentCommitId"`
+		FailureMessage  string `json:"failureMessage"`
+		Timedout        bool   `json:"timedout"`
+	} `json:"detailedStatus"`
+	Parameters cherryPickReq `json:"parameters"`
+	URL        string        `json:"url"`
+}
+
+type taggedObject struct {
+	ObjectID string `json:"objectId"`
+}
+
+type annotatedTag struct {
+	Name         string       `json:"name"`
+	TaggedObject taggedObject `json:"taggedObject"`
+	Message      string       `json:"message"`
+}
+
 type commits struct {
 	Count int `json:"count"`
 	Value []struct {
-		CommitID     string `json:"commitId"`
-		Comment      string `json:"comment"`
+		CommitID     string   `json:"commitId"`
+		Comment      string   `json:"comment"`
+		Parents      []string `json:"parents"`
 		ChangeCounts struct {
 			Add int `json:"Add"`
 		} `json:"changeCounts"`
@@ -75,9 +190,9 @@ type newContent struct {
 }
 
 type change struct {
-	ChangeType string     `json:"changeType"`
-	Item       item       `json:"item"`
-	NewContent newContent `json:"newContent"`
+	ChangeType string      `json:"changeType"`
+	Item       item        `json:"item"`
+	NewContent *newContent `json:"newContent,omitempty"`
 }
 
 type pushCommit struct {
@@ -90,13 +205,26 @@ type push struct {
 	Commits    []pushCommit `json:"commits"`
 }
 
-type version struct {
-	Name  string `xml:"name,attr"`
-	Value string `xml:"value,attr"`
+type items struct {
+	Count int `json:"count"`
+	Value []struct {
+		ObjectID      string `json:"objectId"`
+		GitObjectType string `json:"gitObjectType"`
+		CommitID      string `json:"commitId"`
+		Path          string `json:"path"`
+		URL           string `json:"url"`
+	} `json:"value"`
 }
 
-type root struct {
-	Versions []version `xml:"versions>version"`
+type pushResult struct {
+	PushID  int `json:"pushId"`
+	Commits []struct {
+		CommitID string `json:"commitId"`
+	} `json:"commits"`
+	RefUpdates []struct {
+		Name        string `json:"name"`
+		NewObjectID string `json:"newObjectId"`
+	} `json:"refUpdates"`
 }
 
 type definition struct {
@@ -109,6 +237,13 @@ type buildReq struct {
 	Parameters   string     `json:"parameters"`
 }
 
+type queuedBuild struct {
+	ID          int    `json:"id"`
+	BuildNumber string `json:"buildNumber"`
+	Status      string `json:"status"`
+	Result      string `json:"result"`
+}
+
 type definitions struct {
 	Count int `json:"count"`
 	Value []struct {
@@ -142,29 +277,124 @@ type builds struct {
 	} `json:"value"`
 }
 
+type gitPullRequest struct {
+	PullRequestID   int          `json:"pullRequestId"`
+	CodeReviewID    int          `json:"codeReviewId"`
+	Status          string       `json:"status"`
+	CreationDate    time.Time    `json:"creationDate"`
+	ClosedDate      time.Time    `json:"closedDate"`
+	Title           string       `json:"title"`
+	Description     string       `json:"description"`
+	SourceRefName   string       `json:"sourceRefName"`
+	TargetRefName   string       `json:"targetRefName"`
+	MergeStatus     string       `json:"mergeStatus"`
+	MergeID         string       `json:"mergeId"`
+	LastMergeCommit gitCommitRef `json:"lastMergeCommit"`
+	CreatedBy       identityRef  `json:"createdBy"`
+	IsDraft         bool         `json:"isDraft"`
+	Repository      struct {
+		Project struct {
+			ID string `json:"id"`
+		} `json:"project"`
+	} `json:"repository"`
+	URL                string `json:"url"`
+	SupportsIterations bool   `json:"supportsIterations"`
+}
+
 type pullRequests struct {
+	Value []gitPullRequest `json:"value"`
+	Count int              `json:"count"`
+}
+
+type labels struct {
 	Value []struct {
-		PullRequestID      int       `json:"pullRequestId"`
-		CodeReviewID       int       `json:"codeReviewId"`
-		Status             string    `json:"status"`
-		CreationDate       time.Time `json:"creationDate"`
-		Title              string    `json:"title"`
-		Description        string    `json:"description"`
-		SourceRefName      string    `json:"sourceRefName"`
-		TargetRefName      string    `json:"targetRefName"`
-		MergeStatus        string    `json:"mergeStatus"`
-		MergeID            string    `json:"mergeId"`
-		URL                string    `json:"url"`
-		SupportsIterations bool      `json:"supportsIterations"`
+		ID     string `json:"id"`
+		Name   string `json:"name"`
+		Active bool   `json:"active"`
 	} `json:"value"`
 	Count int `json:"count"`
 }
 
+type comment struct {
+	ID              int    `json:"id,omitempty"`
+	ParentCommentID int    `json:"parentCommentId"`
+	Content         string `json:"content"`
+	CommentType     string `json:"commentType"`
+}
+
+type commentUpdate struct {
+	Content string `json:"content"`
+}
+
+type commentThread struct {
+	ID       int       `json:"id,omitempty"`
+	Comments []comment `json:"comments"`
+	Status   string    `json:"status"`
+}
+
+type commentThreads struct {
+	Value []commentThread `json:"value"`
+	Count int             `json:"count"`
+}
+
 type pullRequest struct {
-	SourceRefName string `json:"sourceRefName"`
+	SourceRefName string         `json:"sourceRefName"`
+	TargetRefName string         `json:"targetRefName"`
+	Title         string         `json:"title"`
+	Description   string         `json:"description"`
+	Reviewers     []reviewer     `json:"reviewers,omitempty"`
+	WorkItemRefs  []resourceRef  `json:"workItemRefs,omitempty"`
+	Labels        []labelRequest `json:"labels,omitempty"`
+	IsDraft       bool           `json:"isDraft,omitempty"`
+}
+
+type reviewer struct {
+	ID         string `json:"id"`
+	IsRequired bool   `json:"isRequired,omitempty"`
+}
+
+type resourceRef struct {
+	ID string `json:"id"`
+}
+
+type labelRequest struct {
+	Name string `json:"name"`
+}
+
+type identityRef struct {
+	ID          string `json:"id"`
+	DisplayName string `json:"displayName"`
+}
+
+type identities struct {
+	Count int `json:"count"`
+	Value []struct {
+		ID                  string `json:"id"`
+		ProviderDisplayName string `json:"providerDisplayName"`
+		IsContainer         bool   `json:"isContainer"`
+	} `json:"value"`
+}
+
+type resourceRefs struct {
+	Count int           `json:"count"`
+	Value []resourceRef `json:"value"`
+}
+
+type autoCompletePullRequest struct {
+	AutoCompleteSetBy identityRef       `json:"autoCompleteSetBy"`
+	CompletionOptions completionOptions `json:"completionOptions"`
+}
+
+type pullRequestStatus struct {
+	Status string `json:"status"`
+}
+
+type pullRequestTarget struct {
 	TargetRefName string `json:"targetRefName"`
-	Title         string `json:"title"`
-	Description   string `json:"description"`
+}
+
+type buildStatus struct {
+	Status string `json:"status"`
 }
 
 type lastMergeSourceCommit struct {
@@ -172,10 +402,12 @@ type lastMergeSourceCommit struct {
 }
 
 type completionOptions struct {
-	DeleteSourceBranch string `json:"deleteSourceBranch"`
-	MergeCommitMessage string `json:"mergeCommitMessage"`
-	SquashMerge        string `json:"squashMerge"`
-	BypassPolicy       string `json:"bypassPolicy"`
+	DeleteSourceBranch  string `json:"deleteSourceBranch"`
+	MergeCommitMessage  string `json:"mergeCommitMessage"`
+	SquashMerge         string `json:"squashMerge"`
+	MergeStrategy       string `json:"mergeStrategy,omitempty"`
+	TransitionWorkItems string `json:"transitionWorkItems"`
+	BypassPolicy        string `json:"bypassPolicy"`
 }
 
 type patchPullRequest struct {
@@ -209,11 +441,11 @@ type diffs struct {
 }
 
 type commit struct {
-	CommitID     string `json:"commitId"`
-	ChangeCounts struct {
-		Edit int `json:"Edit"`
-	} `json:"changeCounts"`
-	Changes []struct {
+	CommitID string `json:"commitId"`
+	// ChangeCounts counts all changes by type, Changes lists at most
+	// commitChangeCount of them.
+	ChangeCounts map[string]int `json:"changeCounts"`
+	Changes      []struct {
 		Item struct {
 			ObjectID         string `json:"objectId"`
 			OriginalObjectID string `json:"originalObjectId"`
@@ -227,14 +459,34 @@ type commit struct {
 	} `json:"changes"`
 }
 
+// changesTruncated tells if the commit has more changes than Changes lists.
+func (c commit) changesTruncated() bool {
+	total := 0
+	for _, n := range c.ChangeCounts {
+		total += n
+	}
+	return total > len(c.Changes)
+}
+
 var secret = secrets{}
 
-func getRelBranches(client *http.Client, relBranch string) refs {
+const versionResetComment = "Reset version for release"
+
+// versionResetTrailer is the commit message trailer naming the release
+// branch of a version reset commit.
+const versionResetTrailer = "Release-Branch"
+
+const zeroObjectID = "0000000000000000000000000000000000000000"
+
+// commitChangeCount is the most changes getCommit lists of a commit.
+const commitChangeCount = 100
+
+func getRelBranches(client *http.Client, repo repoConfig, relBranch string) refs {
 	getBranchURLTemplate := "https://{instance}/DefaultCollection/{project}/_apis/git/repositories/{repository}/refs/heads/{branch}?api-version={version}"
 	r := strings.NewReplacer(
 		"{instance}", secret.Instance,
 		"{project}", secret.Project,
-		"{repository}", secret.Repo,
+		"{repository}", repo.Repo,
 		"{branch}", relBranch,
 		"{version}", "1.0")
 
@@ -242,13 +494,13 @@ func getRelBranches(client *http.Client, relBranch string) refs {
 
 	req, err := http.NewRequest("GET", urlString, nil)
 	if err != nil {
-		log.Fatal(err)
+		log.Panic(err)
 	}
 
 	req.SetBasicAuth(secret.Username, secret.Password)
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Fatal(err)
+		log.Panic(err)
 	}
 	defer resp.Body.Close()
 
@@ -259,26 +511,26 @@ func getRelBranches(client *http.Client, relBranch string) refs {
 	return relBranches
 }
 
-func getMasterBranch(client *http.Client) ref {
+func getMasterBranch(client *http.Client, repo repoConfig) ref {
 	getBranchURLTemplate := "https://{instance}/DefaultCollection/{project}/_apis/git/repositories/{repository}/refs/heads/{branch}?api-version={version}"
 	r := strings.NewReplacer(
 		"{instance}", secret.Instance,
 		"{project}", secret.Project,
-		"{repository}", secret.Repo,
-		"{branch}", secret.MasterBranch,
+		"{repository}", repo.Repo,
+		"{branch}", repo.MasterBranch,
 		"{version}", "1.0")
 
 	urlString := r.Replace(getBranchURLTemplate)
 
 	req, err := http.NewRequest("GET", urlString, nil)
 	if err != nil {
-		log.Fatal(err)
+		log.Panic(err)
 	}
 
 	req.SetBasicAuth(secret.Username, secret.Password)
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Fatal(err)
+		log.Panic(err)
 	}
 	defer resp.Body.Close()
 
@@ -289,12 +541,12 @@ func getMasterBranch(client *http.Client) ref {
 	fmt.Printf("master branches: %v\n", masterBranches.Count)
 
 	if masterBranches.Count == 0 {
-		panic(fmt.Sprintf("No %v branch found", secret.MasterBranch))
+		panic(fmt.Sprintf("No %v branch found", repo.MasterBranch))
 	}
 
 	masterBranch := masterBranches.Value[0]
 	for i := range masterBranches.Value {
-		if masterBranches.Value[i].Name == secret.MasterBranch {
+		if masterBranches.Value[i].Name == repo.MasterBranch {
 			masterBranch = masterBranches.Value[i]
 			break
 		}
@@ -302,10 +554,10 @@ func getMasterBranch(client *http.Client) ref {
 	return masterBranch
 }
 
-func createBranch(client *http.Client, relBranch string, commitID string) {
+func createBranch(client *http.Client, repo repoConfig, relBranch string, commitID string) {
 	newBranch := branch{
 		Name:        fmt.Sprintf("%s/%s", "refs/heads", relBranch),
-		OldObjectID: "0000000000000000000000000000000000000000",
+		OldObjectID: zeroObjectID,
 		NewObjectID: commitID,
 	}
 
@@ -313,7 +565,7 @@ func createBranch(client *http.Client, relBranch string, commitID string) {
 	r := strings.NewReplacer(
 		"{instance}", secret.Instance,
 		"{project}", secret.Project,
-		"{repository}", secret.Repo,
+		"{repository}", repo.Repo,
 		"{version}", "1.0")
 
 	urlString := r.Replace(postBranchURLTemplate)
@@ -322,7 +574,7 @@ func createBranch(client *http.Client, relBranch string, commitID string) {
 
 	req, err := http.NewRequest("POST", urlString, body)
 	if err != nil {
-		log.Fatal(err)
+		log.Panic(err)
 	}
 
 	req.SetBasicAuth(secret.Username, secret.Password)
@@ -330,582 +582,1851 @@ func createBranch(client *http.Client, relBranch string, commitID string) {
 
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Fatal(err)
+		log.Panic(err)
 	}
 	defer resp.Body.Close()
 
 	fmt.Println(resp.Status)
 }
 
-func getCommits(client *http.Client, relBranch string, startTime time.Time, endTime time.Time) commits {
-	toText, _ := endTime.MarshalText()
-	fromText, _ := startTime.MarshalText()
-	fmt.Printf("Finding commits from %s to %s...\n", string(fromText), string(toText))
+func deleteBranch(client *http.Client, repo repoConfig, relBranch string, commitID string) bool {
+	oldBranch := branch{
+		Name:        fmt.Sprintf("%s/%s", "refs/heads", relBranch),
+		OldObjectID: commitID,
+		NewObjectID: zeroObjectID,
+	}
 
-	getCommitsURLTemplate := "https://{instance}/DefaultCollection/{project}/_apis/git/repositories/{repository}/commits?api-version={version}&branch={branch}&itemPath={versionPath}&fromDate={fromDateTime}&toDate={toDateTime}"
+	postBranchURLTemplate := "https://{instance}/DefaultCollection/{project}/_apis/git/repositories/{repository}/refs?api-version={version}"
 	r := strings.NewReplacer(
 		"{instance}", secret.Instance,
 		"{project}", secret.Project,
-		"{repository}", secret.Repo,
-		"{branch}", relBranch,
-		"{versionPath}", secret.VersionPath,
-		"{fromDateTime}", string(fromText),
-		"{toDateTime}", string(toText),
+		"{repository}", repo.Repo,
 		"{version}", "1.0")
 
-	urlString := r.Replace(getCommitsURLTemplate)
+	urlString := r.Replace(postBranchURLTemplate)
+	body := new(bytes.Buffer)
+	json.NewEncoder(body).Encode([]branch{oldBranch})
 
-	req, err := http.NewRequest("GET", urlString, nil)
+	req, err := http.NewRequest("POST", urlString, body)
 	if err != nil {
-		log.Fatal(err)
+		log.Panic(err)
 	}
 
 	req.SetBasicAuth(secret.Username, secret.Password)
+	req.Header.Set("Content-Type", "application/json")
+
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Fatal(err)
+		log.Panic(err)
 	}
 	defer resp.Body.Close()
 
-	commits := commits{}
+	results := refUpdateResults{}
+	json.NewDecoder(resp.Body).Decode(&results)
 
-	json.NewDecoder(resp.Body).Decode(&commits)
-	return commits
+	fmt.Printf("Delete branch %s at %s...\n", relBranch, commitID)
+	fmt.Println(resp.Status)
+
+	return results.Count == 1 && results.Value[0].Success
 }
 
-func getBranchVersionXML(client *http.Client, branch string) root {
-	getItemURLTemplate := "https://{instance}/DefaultCollection/{project}/_apis/git/repositories/{repository}/items?api-version={version}&versionType={versionType}&version={versionValue}&scopePath={versionPath}&lastProcessedChange=true"
+func getRefs(client *http.Client, repo repoConfig, filter string) refs {
+	getRefsURLTemplate := "https://{instance}/DefaultCollection/{project}/_apis/git/repositories/{repository}/refs/{filter}?api-version={version}"
 	r := strings.NewReplacer(
 		"{instance}", secret.Instance,
 		"{project}", secret.Project,
-		"{repository}", secret.Repo,
-		"{versionType}", "branch",
-		"{versionValue}", branch,
-		"{versionPath}", secret.VersionPath,
+		"{repository}", repo.Repo,
+		"{filter}", filter,
 		"{version}", "1.0")
 
-	urlString := r.Replace(getItemURLTemplate)
+	urlString := r.Replace(getRefsURLTemplate)
 
 	req, err := http.NewRequest("GET", urlString, nil)
 	if err != nil {
-		log.Fatal(err)
+		log.Panic(err)
 	}
 
 	req.SetBasicAuth(secret.Username, secret.Password)
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Fatal(err)
+		log.Panic(err)
 	}
 	defer resp.Body.Close()
 
-	bodyText, _ := ioutil.ReadAll(resp.Body)
+	refs := refs{}
 
-	versionXML := root{}
+	json.NewDecoder(resp.Body).Decode(&refs)
 
-	err = xml.Unmarshal(bodyText, &versionXML)
-	if err != nil {
-		log.Fatal(err)
-	}
-	return versionXML
+	return refs
 }
 
-func getCommitVersionXML(client *http.Client, commitID string) root {
-	getItemURLTemplate := "https://{instance}/DefaultCollection/{project}/_apis/git/repositories/{repository}/items?api-version={version}&versionType={versionType}&version={versionValue}&scopePath={versionPath}&lastProcessedChange=true"
-	r := strings.NewReplacer(
-		"{instance}", secret.Instance,
-		"{project}", secret.Project,
-		"{repository}", secret.Repo,
-		"{versionType}", "commit",
-		"{versionValue}", commitID,
-		"{versionPath}", secret.VersionPath,
-		"{version}", "1.0")
-
-	urlString := r.Replace(getItemURLTemplate)
-
-	req, err := http.NewRequest("GET", urlString, nil)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	req.SetBasicAuth(secret.Username, secret.Password)
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Fatal(err)
+// findRef looks up the full ref name, getRefs matches its filter as a
+// prefix.
+func findRef(client *http.Client, repo repoConfig, name string) (ref, bool) {
+	for _, r := range getRefs(client, repo, strings.TrimPrefix(name, "refs/")).Value {
+		if r.Name == name {
+			return r, true
+		}
 	}
-	defer resp.Body.Close()
-
-	bodyText, _ := ioutil.ReadAll(resp.Body)
+	return ref{}, false
+}
 
-	versionXML := root{}
-	err = xml.Unmarshal(bodyText, &versionXML)
-	if err != nil {
-		log.Fatal(err)
+// releaseBranches returns the names of the release branches of repo,
+// oldest first: release branch names sort by date.
+func releaseBranches(client *http.Client, repo repoConfig) []string {
+	names := []string{}
+	for _, b := range getRelBranches(client, repo, repo.ReleaseBranchPrefix).Value {
+		name := strings.TrimPrefix(b.Name, "refs/heads/")
+		if strings.HasPrefix(name, repo.ReleaseBranchPrefix) {
+			names = append(names, name)
+		}
 	}
-	return versionXML
+	sort.Strings(names)
+	return names
 }
 
-func resetBuildVersion(client *http.Client, versionXML root, build string, relBranch string, commitID string) {
-	versions := strings.Split(versionXML.Versions[0].Value, ".")
-	versions[len(versions)-2] = build
-	versions[len(versions)-1] = "0"
-	versionXML.Versions[0].Value = strings.Join(versions, ".")
-	fmt.Printf("Reset version to: %s\n", versionXML.Versions[0].Value)
-	content, err := xml.MarshalIndent(versionXML, "", "  ")
+// updateRef moves the full ref name from oldObjectID to newObjectID, an
+// all zero id creates or deletes the ref.
+func updateRef(client *http.Client, repo repoConfig, name string, oldObjectID string, newObjectID string) bool {
+	refUpdate := branch{
+		Name:        name,
+		OldObjectID: oldObjectID,
+		NewObjectID: newObjectID,
+	}
 
-	postPushURLTemplate := "https://{instance}/DefaultCollection/{project}/_apis/git/repositories/{repository}/pushes?api-version={version}"
+	postRefsURLTemplate := "https://{instance}/DefaultCollection/{project}/_apis/git/repositories/{repository}/refs?api-version={version}"
 	r := strings.NewReplacer(
 		"{instance}", secret.Instance,
 		"{project}", secret.Project,
-		"{repository}", secret.Repo,
-		"{version}", "2.0-preview")
-
-	urlString := r.Replace(postPushURLTemplate)
+		"{repository}", repo.Repo,
+		"{version}", "1.0")
 
-	versionResetPush := push{
-		RefUpdates: []refUpdate{
-			{
-				Name:        fmt.Sprintf("%s/%s", "refs/heads", relBranch),
-				OldObjectID: commitID,
-			},
-		},
-		Commits: []pushCommit{
-			{
-				Comment: "Reset version for release",
-				Changes: []change{
-					{
-						ChangeType: "edit",
-						Item: item{
-							Path: secret.VersionPath,
-						},
-						NewContent: newContent{
-							ContentType: "rawtext",
-							Content:     string(content),
-						},
-					},
-				},
-			},
-		},
-	}
+	urlString := r.Replace(postRefsURLTemplate)
 	body := new(bytes.Buffer)
-	json.NewEncoder(body).Encode(versionResetPush)
+	json.NewEncoder(body).Encode([]branch{refUpdate})
 
 	req, err := http.NewRequest("POST", urlString, body)
 	if err != nil {
-		log.Fatal(err)
+		log.Panic(err)
 	}
+
 	req.SetBasicAuth(secret.Username, secret.Password)
 	req.Header.Set("Content-Type", "application/json")
 
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Fatal(err)
+		log.Panic(err)
 	}
 	defer resp.Body.Close()
 
-	fmt.Printf("Reset version in %s\n", relBranch)
+	results := refUpdateResults{}
+	json.NewDecoder(resp.Body).Decode(&results)
+
+	fmt.Printf("Update %s from %s to %s...\n", name, oldObjectID, newObjectID)
 	fmt.Println(resp.Status)
+
+	return results.Count == 1 && results.Value[0].Success
 }
 
-func getBuildDefinitions(client *http.Client, relBranch string) definitions {
-	relBranch = strings.Replace(relBranch, "/", "_", -1)
-	getDefinitionsURLTemplate := "https://{instance}/DefaultCollection/{project}/_apis/build/definitions?api-version={version}&path={path}&name={definitionName}"
+// getTag returns the tag called name, with the tagged commit peeled off
+// an annotated tag.
+func getTag(client *http.Client, repo repoConfig, name string) (ref, bool) {
+	getRefsURLTemplate := "https://{instance}/DefaultCollection/{project}/_apis/git/repositories/{repository}/refs?api-version={version}&filter={filter}&peelTags=true"
 	r := strings.NewReplacer(
 		"{instance}", secret.Instance,
 		"{project}", secret.Project,
-		"{version}", "3.0-preview.2",
-		"{path}", fmt.Sprintf("%s\\%s", secret.DefinitionPathPrefix, relBranch),
-		"{definitionName}", secret.DefinitionName)
+		"{repository}", repo.Repo,
+		"{filter}", fmt.Sprintf("%s/%s", "tags", name),
+		"{version}", "4.1")
 
-	urlString := r.Replace(getDefinitionsURLTemplate)
+	urlString := r.Replace(getRefsURLTemplate)
 
 	req, err := http.NewRequest("GET", urlString, nil)
 	if err != nil {
-		log.Fatal(err)
+		log.Panic(err)
 	}
-	req.SetBasicAuth(secret.Username, secret.Password)
 
+	req.SetBasicAuth(secret.Username, secret.Password)
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Fatal(err)
+		log.Panic(err)
 	}
 	defer resp.Body.Close()
 
-	defs := definitions{}
-	fmt.Println(resp.Status)
-	json.NewDecoder(resp.Body).Decode(&defs)
+	tags := refs{}
 
-	return defs
+	json.NewDecoder(resp.Body).Decode(&tags)
+
+	for _, tag := range tags.Value {
+		if tag.Name == fmt.Sprintf("%s/%s", "refs/tags", name) {
+			return tag, true
+		}
+	}
+	return ref{}, false
 }
 
-func onboardBuildDefinition(client *http.Client, relBranch string) {
-	postBuildURLTemplate := "https://{instance}/DefaultCollection/{project}/_apis/build/builds?api-version={version}"
+func createAnnotatedTag(client *http.Client, repo repoConfig, name string, commitID string, message string) bool {
+	tag := annotatedTag{
+		Name: name,
+		TaggedObject: taggedObject{
+			ObjectID: commitID,
+		},
+		Message: message,
+	}
+
+	postTagURLTemplate := "https://{instance}/DefaultCollection/{project}/_apis/git/repositories/{repository}/annotatedtags?api-version={version}"
 	r := strings.NewReplacer(
 		"{instance}", secret.Instance,
 		"{project}", secret.Project,
-		"{version}", "2.0")
-
-	urlString := r.Replace(postBuildURLTemplate)
+		"{repository}", repo.Repo,
+		"{version}", "4.1-preview.1")
 
-	onboardBuild := buildReq{
-		Definition: definition{
-			ID: secret.OnboardBuildDefinitionID,
-		},
-		SourceBranch: fmt.Sprintf("%s/%s", "refs/heads", "master"),
-		Parameters:   fmt.Sprintf("{\"GitRepositoryName\":\"Compute-CloudShell\",\"GitBranchName\":\"%s\"}", relBranch),
-	}
+	urlString := r.Replace(postTagURLTemplate)
 	body := new(bytes.Buffer)
-	json.NewEncoder(body).Encode(onboardBuild)
+	json.NewEncoder(body).Encode(tag)
 
 	req, err := http.NewRequest("POST", urlString, body)
 	if err != nil {
-		log.Fatal(err)
+		log.Panic(err)
 	}
+
 	req.SetBasicAuth(secret.Username, secret.Password)
 	req.Header.Set("Content-Type", "application/json")
 
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Fatal(err)
+		log.Panic(err)
 	}
 	defer resp.Body.Close()
 
-	fmt.Println("Onboarding...")
+	fmt.Printf("Create tag %s at %s...\n", name, commitID)
 	fmt.Println(resp.Status)
+
+	return resp.StatusCode == http.StatusCreated || resp.StatusCode == http.StatusOK
 }
 
-func getBuilds(client *http.Client, defID int) builds {
-	getBuildsURLTemplate := "https://{instance}/DefaultCollection/{project}/_apis/build/builds?api-version={version}&definitions={defID}"
+func getCommits(client *http.Client, repo repoConfig, relBranch string, startTime time.Time, endTime time.Time) commits {
+	toText, _ := endTime.MarshalText()
+	fromText, _ := startTime.MarshalText()
+	fmt.Printf("Finding commits from %s to %s...\n", string(fromText), string(toText))
+
+	getCommitsURLTemplate := "https://{instance}/DefaultCollection/{project}/_apis/git/repositories/{repository}/commits?api-version={version}&branch={branch}&itemPath={versionPath}&fromDate={fromDateTime}&toDate={toDateTime}"
 	r := strings.NewReplacer(
 		"{instance}", secret.Instance,
 		"{project}", secret.Project,
-		"{version}", "2.0",
-		"{defID}", strconv.Itoa(defID))
+		"{repository}", repo.Repo,
+		"{branch}", relBranch,
+		"{versionPath}", repo.VersionPath,
+		"{fromDateTime}", string(fromText),
+		"{toDateTime}", string(toText),
+		"{version}", "1.0")
+
+	urlString := r.Replace(getCommitsURLTemplate)
 
-	urlString := r.Replace(getBuildsURLTemplate)
 	req, err := http.NewRequest("GET", urlString, nil)
 	if err != nil {
-		log.Fatal(err)
+		log.Panic(err)
 	}
 
 	req.SetBasicAuth(secret.Username, secret.Password)
-	req.Header.Set("Content-Type", "application/json")
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Fatal(err)
+		log.Panic(err)
 	}
 	defer resp.Body.Close()
 
-	builds := builds{}
-	fmt.Println(resp.Status)
-	json.NewDecoder(resp.Body).Decode(&builds)
+	commits := commits{}
 
-	return builds
+	json.NewDecoder(resp.Body).Decode(&commits)
+	return commits
 }
 
-func postBuild(client *http.Client, relBranch string, buildDefID int) {
-	postBuildURLTemplate := "https://{instance}/DefaultCollection/{project}/_apis/build/builds?api-version={version}"
+func getItemContent(client *http.Client, repo repoConfig, versionType string, versionValue string) ([]byte, error) {
+	content, found, err := getFileContent(client, repo, repo.VersionPath, versionType, versionValue)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("get %s at %s %s: %s", repo.VersionPath, versionType, versionValue, "404 Not Found")
+	}
+	return content, nil
+}
+
+// getFileContent returns the content of the file at filePath, found is
+// false if there is none at versionValue.
+func getFileContent(client *http.Client, repo repoConfig, filePath string, versionType string, versionValue string) ([]byte, bool, error) {
+	getItemURLTemplate := "https://{instance}/DefaultCollection/{project}/_apis/git/repositories/{repository}/items?api-version={version}&versionType={versionType}&version={versionValue}&scopePath={path}&lastProcessedChange=true"
 	r := strings.NewReplacer(
 		"{instance}", secret.Instance,
 		"{project}", secret.Project,
-		"{version}", "2.0")
+		"{repository}", repo.Repo,
+		"{versionType}", versionType,
+		"{versionValue}", versionValue,
+		"{path}", url.QueryEscape(filePath),
+		"{version}", "1.0")
 
-	urlString := r.Replace(postBuildURLTemplate)
+	urlString := r.Replace(getItemURLTemplate)
 
-	relBuild := buildReq{
-		Definition: definition{
-			ID: buildDefID,
-		},
-		SourceBranch: fmt.Sprintf("%s/%s", "refs/heads", relBranch),
-	}
-	body := new(bytes.Buffer)
-	json.NewEncoder(body).Encode(relBuild)
-	req, err := http.NewRequest("POST", urlString, body)
+	req, err := http.NewRequest("GET", urlString, nil)
 	if err != nil {
-		log.Fatal(err)
+		return nil, false, err
 	}
 
 	req.SetBasicAuth(secret.Username, secret.Password)
-	req.Header.Set("Content-Type", "application/json")
-
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Fatal(err)
+		return nil, false, err
 	}
 	defer resp.Body.Close()
 
-	fmt.Println("Building...")
-	fmt.Println(resp.Status)
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, false, nil
+	}
+	bodyText, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, false, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, false, fmt.Errorf("get %s at %s %s: %s", filePath, versionType, versionValue, resp.Status)
+	}
+	return bodyText, true, nil
 }
 
-func getPullRequests(client *http.Client, targetBranch string, sourceBranch string) pullRequests {
-	getPullRequestsURLTemplate := "https://{instance}/DefaultCollection/{project}/_apis/git/repositories/{repository}/pullRequests?api-version={version}&status={status}&sourceRefName={sourceBranch}&targetRefName={targetBranch}"
+// getItemObjectID returns the blob id of the version file at versionValue.
+func getItemObjectID(ctx context.Context, client *http.Client, repo repoConfig, versionType string, versionValue string) (string, error) {
+	getItemURLTemplate := "https://{instance}/DefaultCollection/{project}/_apis/git/repositories/{repository}/items?api-version={version}&versionType={versionType}&version={versionValue}&scopePath={versionPath}&$format=json"
 	r := strings.NewReplacer(
 		"{instance}", secret.Instance,
 		"{project}", secret.Project,
-		"{repository}", secret.Repo,
-		"{version}", "3.0-preview",
-		"{status}", "Active",
-		"{sourceBranch}", fmt.Sprintf("%s/%s", "refs/heads", sourceBranch),
-		"{targetBranch}", fmt.Sprintf("%s/%s", "refs/heads", targetBranch))
+		"{repository}", repo.Repo,
+		"{versionType}", versionType,
+		"{versionValue}", versionValue,
+		"{versionPath}", repo.VersionPath,
+		"{version}", "1.0")
 
-	urlString := r.Replace(getPullRequestsURLTemplate)
+	urlString := r.Replace(getItemURLTemplate)
 
 	req, err := http.NewRequest("GET", urlString, nil)
 	if err != nil {
-		log.Fatal(err)
+		return "", err
 	}
 
 	req.SetBasicAuth(secret.Username, secret.Password)
-	resp, err := client.Do(req)
+	resp, err := client.Do(req.WithContext(ctx))
 	if err != nil {
-		log.Fatal(err)
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("get %s at %s %s: %s", repo.VersionPath, versionType, versionValue, resp.Status)
+	}
+
+	items := items{}
+	if err := json.NewDecoder(resp.Body).Decode(&items); err != nil {
+		return "", err
+	}
+	if items.Count == 0 || items.Value[0].GitObjectType != "blob" {
+		return "", fmt.Errorf("%s at %s %s is not a file", repo.VersionPath, versionType, versionValue)
+	}
+	return items.Value[0].ObjectID, nil
+}
+
+func getBlob(ctx context.Context, client *http.Client, repo repoConfig, objectID string) ([]byte, error) {
+	getBlobURLTemplate := "https://{instance}/DefaultCollection/{project}/_apis/git/repositories/{repository}/blobs/{objectId}?api-version={version}&$format=octetstream"
+	r := strings.NewReplacer(
+		"{instance}", secret.Instance,
+		"{project}", secret.Project,
+		"{repository}", repo.Repo,
+		"{objectId}", objectID,
+		"{version}", "1.0")
+
+	urlString := r.Replace(getBlobURLTemplate)
+
+	req, err := http.NewRequest("GET", urlString, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.SetBasicAuth(secret.Username, secret.Password)
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	bodyText, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("get blob %s: %s", objectID, resp.Status)
+	}
+	return bodyText, nil
+}
+
+func getVersionFile(client *http.Client, repo repoConfig, versionType string, versionValue string) (versionFile, error) {
+	content, err := getItemContent(client, repo, versionType, versionValue)
+	if err != nil {
+		return nil, err
+	}
+
+	versionFile, err := parseVersionFile(versionFormat(repo), content)
+	if err != nil {
+		return nil, fmt.Errorf("parse %s at %s %s: %v", repo.VersionPath, versionType, versionValue, err)
+	}
+	return versionFile, nil
+}
+
+func getBranchVersionFile(client *http.Client, repo repoConfig, branch string) (versionFile, error) {
+	return getVersionFile(client, repo, "branch", branch)
+}
+
+func getCommitVersionFile(client *http.Client, repo repoConfig, commitID string) (versionFile, error) {
+	return getVersionFile(client, repo, "commit", commitID)
+}
+
+func resetBuildVersion(client *http.Client, repo repoConfig, scheme versionScheme, versionFile versionFile, build string, relBranch string, commitID string) (string, error) {
+	resets, err := resetVersions(repo, versionFile)
+	if err != nil {
+		return "", err
+	}
+
+	for _, current := range resets {
+		value, err := scheme.Release(current.Value, build)
+		if err != nil {
+			return "", err
+		}
+		if err := versionFile.SetVersion(current.Name, value); err != nil {
+			return "", err
+		}
+		fmt.Printf("Reset version %s to: %s\n", current.Name, value)
+	}
+
+	relVersion, err := buildVersion(repo, versionFile)
+	if err != nil {
+		return "", err
+	}
+
+	comment := fmt.Sprintf("%s\n\n%s: %s", versionResetComment, versionResetTrailer, relBranch)
+	resetCommitID := pushVersionFile(client, repo, versionFile, relBranch, commitID, comment)
+	if resetCommitID == "" {
+		return "", fmt.Errorf("push version to %s failed", relBranch)
+	}
+	fmt.Printf("Reset version in %s\n", relBranch)
+
+	if !updateRef(client, repo, versionResetMarker(relBranch), zeroObjectID, resetCommitID) {
+		fmt.Printf("Warning: failed to mark version reset of %s\n", relBranch)
+	}
+
+	return relVersion.Value, nil
+}
+
+// pushVersionFile commits versionFile on top of commitID in branch and
+// returns the new commit, empty if the push failed.
+func pushVersionFile(client *http.Client, repo repoConfig, versionFile versionFile, branch string, commitID string, comment string) string {
+	return pushVersionChanges(client, repo, versionFile, branch, commitID, comment, nil)
+}
+
+// pushVersionChanges commits versionFile together with more changes on top
+// of commitID in branch and returns the new commit, empty if the push
+// failed.
+func pushVersionChanges(client *http.Client, repo repoConfig, versionFile versionFile, branch string, commitID string, comment string, more []change) string {
+	content, err := versionFile.Marshal()
+	if err != nil {
+		log.Panic(err)
+	}
+
+	postPushURLTemplate := "https://{instance}/DefaultCollection/{project}/_apis/git/repositories/{repository}/pushes?api-version={version}"
+	r := strings.NewReplacer(
+		"{instance}", secret.Instance,
+		"{project}", secret.Project,
+		"{repository}", repo.Repo,
+		"{version}", "2.0-preview")
+
+	urlString := r.Replace(postPushURLTemplate)
+
+	changes := []change{
+		{
+			ChangeType: "edit",
+			Item: item{
+				Path: repo.VersionPath,
+			},
+			NewContent: &newContent{
+				ContentType: "rawtext",
+				Content:     string(content),
+			},
+		},
+	}
+	versionPush := push{
+		RefUpdates: []refUpdate{
+			{
+				Name:        fmt.Sprintf("%s/%s", "refs/heads", branch),
+				OldObjectID: commitID,
+			},
+		},
+		Commits: []pushCommit{
+			{
+				Comment: comment,
+				Changes: append(changes, more...),
+			},
+		},
+	}
+	body := new(bytes.Buffer)
+	json.NewEncoder(body).Encode(versionPush)
+
+	req, err := http.NewRequest("POST", urlString, body)
+	if err != nil {
+		log.Panic(err)
+	}
+	req.SetBasicAuth(secret.Username, secret.Password)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer resp.Body.Close()
+
+	fmt.Printf("Push version to %s\n", branch)
+	fmt.Println(resp.Status)
+
+	pushResult := pushResult{}
+	json.NewDecoder(resp.Body).Decode(&pushResult)
+	if resp.StatusCode != http.StatusCreated || len(pushResult.Commits) == 0 {
+		return ""
+	}
+	return pushResult.Commits[len(pushResult.Commits)-1].CommitID
+}
+
+func getBuildDefinitions(client *http.Client, repo repoConfig, relBranch string) definitions {
+	relBranch = strings.Replace(relBranch, "/", "_", -1)
+	getDefinitionsURLTemplate := "https://{instance}/DefaultCollection/{project}/_apis/build/definitions?api-version={version}&path={path}&name={definitionName}"
+	r := strings.NewReplacer(
+		"{instance}", secret.Instance,
+		"{project}", secret.Project,
+		"{version}", "3.0-preview.2",
+		"{path}", fmt.Sprintf("%s\\%s", repo.DefinitionPathPrefix, relBranch),
+		"{definitionName}", repo.DefinitionName)
+
+	urlString := r.Replace(getDefinitionsURLTemplate)
+
+	req, err := http.NewRequest("GET", urlString, nil)
+	if err != nil {
+		log.Panic(err)
+	}
+	req.SetBasicAuth(secret.Username, secret.Password)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer resp.Body.Close()
+
+	defs := definitions{}
+	fmt.Println(resp.Status)
+	json.NewDecoder(resp.Body).Decode(&defs)
+
+	return defs
+}
+
+// onboardBuildDefinition queues the build which creates the build
+// definition of relBranch and returns its id, 0 if it was not queued.
+func onboardBuildDefinition(client *http.Client, repo repoConfig, relBranch string) int {
+	postBuildURLTemplate := "https://{instance}/DefaultCollection/{project}/_apis/build/builds?api-version={version}"
+	r := strings.NewReplacer(
+		"{instance}", secret.Instance,
+		"{project}", secret.Project,
+		"{version}", "2.0")
+
+	urlString := r.Replace(postBuildURLTemplate)
+
+	repositoryName := repo.OnboardRepositoryName
+	if repositoryName == "" {
+		repositoryName = "Compute-CloudShell"
+	}
+
+	onboardBuild := buildReq{
+		Definition: definition{
+			ID: repo.OnboardBuildDefinitionID,
+		},
+		SourceBranch: fmt.Sprintf("%s/%s", "refs/heads", "master"),
+		Parameters:   fmt.Sprintf("{\"GitRepositoryName\":\"%s\",\"GitBranchName\":\"%s\"}", repositoryName, relBranch),
+	}
+	body := new(bytes.Buffer)
+	json.NewEncoder(body).Encode(onboardBuild)
+
+	req, err := http.NewRequest("POST", urlString, body)
+	if err != nil {
+		log.Panic(err)
+	}
+	req.SetBasicAuth(secret.Username, secret.Password)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer resp.Body.Close()
+
+	fmt.Println("Onboarding...")
+	fmt.Println(resp.Status)
+
+	queued := queuedBuild{}
+	json.NewDecoder(resp.Body).Decode(&queued)
+	return queued.ID
+}
+
+func getBuild(client *http.Client, buildID int) queuedBuild {
+	getBuildURLTemplate := "https://{instance}/DefaultCollection/{project}/_apis/build/builds/{buildId}?api-version={version}"
+	r := strings.NewReplacer(
+		"{instance}", secret.Instance,
+		"{project}", secret.Project,
+		"{version}", "2.0",
+		"{buildId}", strconv.Itoa(buildID))
+
+	urlString := r.Replace(getBuildURLTemplate)
+	req, err := http.NewRequest("GET", urlString, nil)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	req.SetBasicAuth(secret.Username, secret.Password)
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer resp.Body.Close()
+
+	build := queuedBuild{}
+
+	json.NewDecoder(resp.Body).Decode(&build)
+	return build
+}
+
+func getBuilds(client *http.Client, defID int) builds {
+	getBuildsURLTemplate := "https://{instance}/DefaultCollection/{project}/_apis/build/builds?api-version={version}&definitions={defID}"
+	r := strings.NewReplacer(
+		"{instance}", secret.Instance,
+		"{project}", secret.Project,
+		"{version}", "2.0",
+		"{defID}", strconv.Itoa(defID))
+
+	urlString := r.Replace(getBuildsURLTemplate)
+	req, err := http.NewRequest("GET", urlString, nil)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	req.SetBasicAuth(secret.Username, secret.Password)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer resp.Body.Close()
+
+	builds := builds{}
+	fmt.Println(resp.Status)
+	json.NewDecoder(resp.Body).Decode(&builds)
+
+	return builds
+}
+
+// postBuild queues a build of relBranch and returns its id, 0 if it was
+// not queued.
+func postBuild(client *http.Client, relBranch string, buildDefID int) int {
+	postBuildURLTemplate := "https://{instance}/DefaultCollection/{project}/_apis/build/builds?api-version={version}"
+	r := strings.NewReplacer(
+		"{instance}", secret.Instance,
+		"{project}", secret.Project,
+		"{version}", "2.0")
+
+	urlString := r.Replace(postBuildURLTemplate)
+
+	relBuild := buildReq{
+		Definition: definition{
+			ID: buildDefID,
+		},
+		SourceBranch: fmt.Sprintf("%s/%s", "refs/heads", relBranch),
+	}
+	body := new(bytes.Buffer)
+	json.NewEncoder(body).Encode(relBuild)
+	req, err := http.NewRequest("POST", urlString, body)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	req.SetBasicAuth(secret.Username, secret.Password)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer resp.Body.Close()
+
+	fmt.Println("Building...")
+	fmt.Println(resp.Status)
+
+	queued := queuedBuild{}
+	json.NewDecoder(resp.Body).Decode(&queued)
+	return queued.ID
+}
+
+func cancelBuild(client *http.Client, buildID int) {
+	patchBuildURLTemplate := "https://{instance}/DefaultCollection/{project}/_apis/build/builds/{buildId}?api-version={version}"
+	r := strings.NewReplacer(
+		"{instance}", secret.Instance,
+		"{project}", secret.Project,
+		"{version}", "2.0",
+		"{buildId}", strconv.Itoa(buildID))
+
+	urlString := r.Replace(patchBuildURLTemplate)
+
+	body := new(bytes.Buffer)
+	json.NewEncoder(body).Encode(buildStatus{Status: "cancelling"})
+	req, err := http.NewRequest("PATCH", urlString, body)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	req.SetBasicAuth(secret.Username, secret.Password)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer resp.Body.Close()
+
+	fmt.Printf("Cancel build %v...\n", buildID)
+	fmt.Println(resp.Status)
+}
+
+func getPullRequests(client *http.Client, repo repoConfig, targetBranch string, sourceBranch string) pullRequests {
+	return searchPullRequests(client, repo, "Active", targetBranch, sourceBranch, 100)
+}
+
+// searchPullRequests lists up to top PRs in status, newest first. An
+// empty branch matches any.
+func searchPullRequests(client *http.Client, repo repoConfig, status string, targetBranch string, sourceBranch string, top int) pullRequests {
+	getPullRequestsURLTemplate := "https://{instance}/DefaultCollection/{project}/_apis/git/repositories/{repository}/pullRequests?api-version={version}&status={status}&$top={top}"
+	if sourceBranch != "" {
+		getPullRequestsURLTemplate += "&sourceRefName={sourceBranch}"
+	}
+	if targetBranch != "" {
+		getPullRequestsURLTemplate += "&targetRefName={targetBranch}"
+	}
+	r := strings.NewReplacer(
+		"{instance}", secret.Instance,
+		"{project}", secret.Project,
+		"{repository}", repo.Repo,
+		"{version}", "3.0-preview",
+		"{status}", status,
+		"{top}", strconv.Itoa(top),
+		"{sourceBranch}", fmt.Sprintf("%s/%s", "refs/heads", sourceBranch),
+		"{targetBranch}", fmt.Sprintf("%s/%s", "refs/heads", targetBranch))
+
+	urlString := r.Replace(getPullRequestsURLTemplate)
+
+	req, err := http.NewRequest("GET", urlString, nil)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	req.SetBasicAuth(secret.Username, secret.Password)
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer resp.Body.Close()
+
+	pullRequests := pullRequests{}
+
+	json.NewDecoder(resp.Body).Decode(&pullRequests)
+
+	return pullRequests
+}
+
+func getPullRequestLabels(client *http.Client, repo repoConfig, pullRequestID int) labels {
+	getLabelsURLTemplate := "https://{instance}/DefaultCollection/{project}/_apis/git/repositories/{repository}/pullRequests/{pullRequest}/labels?api-version={version}"
+	r := strings.NewReplacer(
+		"{instance}", secret.Instance,
+		"{project}", secret.Project,
+		"{repository}", repo.Repo,
+		"{pullRequest}", strconv.Itoa(pullRequestID),
+		"{version}", "4.1-preview.1")
+
+	urlString := r.Replace(getLabelsURLTemplate)
+
+	req, err := http.NewRequest("GET", urlString, nil)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	req.SetBasicAuth(secret.Username, secret.Password)
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer resp.Body.Close()
+
+	labels := labels{}
+
+	json.NewDecoder(resp.Body).Decode(&labels)
+
+	return labels
+}
+
+func updatePullRequestComment(client *http.Client, repo repoConfig, pullRequestID int, threadID int, commentID int, content string) {
+	patchCommentURLTemplate := "https://{instance}/DefaultCollection/{project}/_apis/git/repositories/{repository}/pullRequests/{pullRequest}/threads/{thread}/comments/{comment}?api-version={version}"
+	r := strings.NewReplacer(
+		"{instance}", secret.Instance,
+		"{project}", secret.Project,
+		"{repository}", repo.Repo,
+		"{pullRequest}", strconv.Itoa(pullRequestID),
+		"{thread}", strconv.Itoa(threadID),
+		"{comment}", strconv.Itoa(commentID),
+		"{version}", "4.1")
+
+	urlString := r.Replace(patchCommentURLTemplate)
+
+	body := new(bytes.Buffer)
+	json.NewEncoder(body).Encode(commentUpdate{Content: content})
+	req, err := http.NewRequest("PATCH", urlString, body)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	req.SetBasicAuth(secret.Username, secret.Password)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer resp.Body.Close()
+
+	fmt.Printf("Update comment on PR %v...\n", pullRequestID)
+	fmt.Println(resp.Status)
+}
+
+func getPullRequestThreads(client *http.Client, repo repoConfig, pullRequestID int) commentThreads {
+	getThreadsURLTemplate := "https://{instance}/DefaultCollection/{project}/_apis/git/repositories/{repository}/pullRequests/{pullRequest}/threads?api-version={version}"
+	r := strings.NewReplacer(
+		"{instance}", secret.Instance,
+		"{project}", secret.Project,
+		"{repository}", repo.Repo,
+		"{pullRequest}", strconv.Itoa(pullRequestID),
+		"{version}", "4.1")
+
+	urlString := r.Replace(getThreadsURLTemplate)
+
+	req, err := http.NewRequest("GET", urlString, nil)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	req.SetBasicAuth(secret.Username, secret.Password)
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer resp.Body.Close()
+
+	threads := commentThreads{}
+
+	json.NewDecoder(resp.Body).Decode(&threads)
+
+	return threads
+}
+
+func postPullRequestThread(client *http.Client, repo repoConfig, pullRequestID int, content string, status string) {
+	postThreadURLTemplate := "https://{instance}/DefaultCollection/{project}/_apis/git/repositories/{repository}/pullRequests/{pullRequest}/threads?api-version={version}"
+	r := strings.NewReplacer(
+		"{instance}", secret.Instance,
+		"{project}", secret.Project,
+		"{repository}", repo.Repo,
+		"{pullRequest}", strconv.Itoa(pullRequestID),
+		"{version}", "4.1")
+
+	urlString := r.Replace(postThreadURLTemplate)
+
+	thread := commentThread{
+		Comments: []comment{
+			{
+				ParentCommentID: 0,
+				Content:         content,
+				CommentType:     "text",
+			},
+		},
+		Status: status,
+	}
+
+	body := new(bytes.Buffer)
+	json.NewEncoder(body).Encode(thread)
+	req, err := http.NewRequest("POST", urlString, body)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	req.SetBasicAuth(secret.Username, secret.Password)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer resp.Body.Close()
+
+	fmt.Printf("Comment on PR %v...\n", pullRequestID)
+	fmt.Println(resp.Status)
+}
+
+func getPullRequest(client *http.Client, repo repoConfig, pullRequestID int) gitPullRequest {
+	getPullRequestURLTemplate := "https://{instance}/DefaultCollection/{project}/_apis/git/repositories/{repository}/pullRequests/{pullRequest}?api-version={version}"
+	r := strings.NewReplacer(
+		"{instance}", secret.Instance,
+		"{project}", secret.Project,
+		"{repository}", repo.Repo,
+		"{pullRequest}", strconv.Itoa(pullRequestID),
+		"{version}", "3.0-preview")
+
+	urlString := r.Replace(getPullRequestURLTemplate)
+
+	req, err := http.NewRequest("GET", urlString, nil)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	req.SetBasicAuth(secret.Username, secret.Password)
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer resp.Body.Close()
+
+	pullRequest := gitPullRequest{}
+
+	json.NewDecoder(resp.Body).Decode(&pullRequest)
+
+	return pullRequest
+}
+
+// submitPullRequest opens a PR with options and returns it as created.
+// Reviewers are resolved by name, auto-complete is set on the new PR.
+func submitPullRequest(client *http.Client, repo repoConfig, sourceBranch string, targetBranch string, title string, description string, options pullRequestOptions) (gitPullRequest, error) {
+	reviewers, err := resolveReviewers(client, options)
+	if err != nil {
+		return gitPullRequest{}, err
+	}
+
+	postPullRequestURLTemplate := "https://{instance}/DefaultCollection/{project}/_apis/git/repositories/{repository}/pullRequests?api-version={version}"
+	r := strings.NewReplacer(
+		"{instance}", secret.Instance,
+		"{project}", secret.Project,
+		"{repository}", repo.Repo,
+		"{version}", "5.1")
+
+	urlString := r.Replace(postPullRequestURLTemplate)
+
+	pullRequest := pullRequest{
+		SourceRefName: fmt.Sprintf("%s/%s", "refs/heads", sourceBranch),
+		TargetRefName: fmt.Sprintf("%s/%s", "refs/heads", targetBranch),
+		Title:         title,
+		Description:   description,
+		Reviewers:     reviewers,
+		IsDraft:       options.Draft,
+	}
+	linked := map[int]bool{}
+	for _, id := range options.WorkItems {
+		if !linked[id] {
+			pullRequest.WorkItemRefs = append(pullRequest.WorkItemRefs, resourceRef{ID: strconv.Itoa(id)})
+			linked[id] = true
+		}
+	}
+	for _, name := range options.Labels {
+		pullRequest.Labels = append(pullRequest.Labels, labelRequest{Name: name})
+	}
+	body := new(bytes.Buffer)
+	json.NewEncoder(body).Encode(pullRequest)
+	req, err := http.NewRequest("POST", urlString, body)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	req.SetBasicAuth(secret.Username, secret.Password)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer resp.Body.Close()
+
+	fmt.Printf("Starting PR from %s to %s...\n", sourceBranch, targetBranch)
+	fmt.Println(resp.Status)
+
+	if resp.StatusCode != http.StatusCreated {
+		bodyText, _ := ioutil.ReadAll(resp.Body)
+		return gitPullRequest{}, fmt.Errorf("create PR from %s to %s: %s %s", sourceBranch, targetBranch, resp.Status, bodyText)
+	}
+
+	created := gitPullRequest{}
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		return gitPullRequest{}, err
+	}
+	fmt.Printf("Created PR %v\n", created.PullRequestID)
+
+	if options.AutoComplete && !created.IsDraft {
+		completion, err := completionOptionsFor(options, created, false)
+		if err != nil {
+			return created, err
+		}
+		if err := setAutoComplete(client, repo, created, completion); err != nil {
+			return created, err
+		}
+	}
+	return created, nil
+}
+
+// setAutoComplete completes the PR as its creator once the policies pass.
+func setAutoComplete(client *http.Client, repo repoConfig, pr gitPullRequest, completion completionOptions) error {
+	patchPullRequestURLTemplate := "https://{instance}/DefaultCollection/{project}/_apis/git/repositories/{repository}/pullRequests/{pullRequest}?api-version={version}"
+	r := strings.NewReplacer(
+		"{instance}", secret.Instance,
+		"{project}", secret.Project,
+		"{repository}", repo.Repo,
+		"{pullRequest}", strconv.Itoa(pr.PullRequestID),
+		"{version}", "5.1")
+
+	urlString := r.Replace(patchPullRequestURLTemplate)
+
+	patch := autoCompletePullRequest{
+		AutoCompleteSetBy: identityRef{ID: pr.CreatedBy.ID},
+		CompletionOptions: completion,
+	}
+
+	body := new(bytes.Buffer)
+	json.NewEncoder(body).Encode(patch)
+	req, err := http.NewRequest("PATCH", urlString, body)
+	if err != nil {
+		return err
+	}
+
+	req.SetBasicAuth(secret.Username, secret.Password)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	fmt.Printf("Set auto-complete on PR %v\n", pr.PullRequestID)
+	fmt.Println(resp.Status)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("set auto-complete on PR %v: %s", pr.PullRequestID, resp.Status)
+	}
+	return nil
+}
+
+// getIdentities searches users and groups by display name, account or
+// email.
+func getIdentities(client *http.Client, name string) (identities, error) {
+	getIdentitiesURLTemplate := "https://{instance}/_apis/identities?api-version={version}&searchFilter=General&queryMembership=None&filterValue={name}"
+	r := strings.NewReplacer(
+		"{instance}", secret.Instance,
+		"{name}", url.QueryEscape(name),
+		"{version}", "4.1")
+
+	urlString := r.Replace(getIdentitiesURLTemplate)
+
+	req, err := http.NewRequest("GET", urlString, nil)
+	if err != nil {
+		return identities{}, err
+	}
+
+	req.SetBasicAuth(secret.Username, secret.Password)
+	resp, err := client.Do(req)
+	if err != nil {
+		return identities{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return identities{}, fmt.Errorf("search identity %q: %s", name, resp.Status)
+	}
+
+	identities := identities{}
+	err = json.NewDecoder(resp.Body).Decode(&identities)
+	return identities, err
+}
+
+func getPullRequestWorkItems(client *http.Client, repo repoConfig, pullRequestID int) resourceRefs {
+	getWorkItemsURLTemplate := "https://{instance}/DefaultCollection/{project}/_apis/git/repositories/{repository}/pullRequests/{pullRequest}/workitems?api-version={version}"
+	r := strings.NewReplacer(
+		"{instance}", secret.Instance,
+		"{project}", secret.Project,
+		"{repository}", repo.Repo,
+		"{pullRequest}", strconv.Itoa(pullRequestID),
+		"{version}", "3.0")
+
+	urlString := r.Replace(getWorkItemsURLTemplate)
+
+	req, err := http.NewRequest("GET", urlString, nil)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	req.SetBasicAuth(secret.Username, secret.Password)
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer resp.Body.Close()
+
+	workItems := resourceRefs{}
+
+	json.NewDecoder(resp.Body).Decode(&workItems)
+
+	return workItems
+}
+
+func getDiffsBetweenBranches(client *http.Client, repo repoConfig, baseBranch string, targetBranch string) diffs {
+	return getDiffs(client, repo, "branch", baseBranch, "branch", targetBranch)
+}
+
+func getDiffs(client *http.Client, repo repoConfig, baseType string, base string, targetType string, target string) diffs {
+	getDiffsURLTemplate := "https://{instance}/DefaultCollection/{project}/_apis/git/repositories/{repository}/diffs/commits?api-version={version}&targetVersionType={targetType}&targetVersion={target}&baseVersionType={baseType}&baseVersion={base}"
+	r := strings.NewReplacer(
+		"{instance}", secret.Instance,
+		"{project}", secret.Project,
+		"{repository}", repo.Repo,
+		"{version}", "1.0",
+		"{baseType}", baseType,
+		"{base}", base,
+		"{targetType}", targetType,
+		"{target}", target)
+
+	urlString := r.Replace(getDiffsURLTemplate)
+
+	req, err := http.NewRequest("GET", urlString, nil)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	req.SetBasicAuth(secret.Username, secret.Password)
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Panic(err)
 	}
 	defer resp.Body.Close()
 
-	pullRequests := pullRequests{}
+	diffs := diffs{}
 
-	json.NewDecoder(resp.Body).Decode(&pullRequests)
+	json.NewDecoder(resp.Body).Decode(&diffs)
 
-	return pullRequests
+	return diffs
 }
 
-func submitPullRequest(client *http.Client, sourceBranch string, targetBranch string, title string, description string) {
-	postPullRequestURLTemplate := "https://{instance}/DefaultCollection/{project}/_apis/git/repositories/{repository}/pullRequests?api-version={version}"
+// getCommitsBetweenBranches lists the commits of targetBranch which are
+// not in baseBranch, newest first, reading them page by page.
+func getCommitsBetweenBranches(client *http.Client, repo repoConfig, baseBranch string, targetBranch string) commits {
+	getCommitsURLTemplate := "https://{instance}/DefaultCollection/{project}/_apis/git/repositories/{repository}/commits?api-version={version}&itemVersion.versionType=branch&itemVersion.version={targetBranch}&compareVersion.versionType=branch&compareVersion.version={baseBranch}&$top={top}&$skip={skip}"
+	const top = 1000
+
+	all := commits{}
+	for skip := 0; ; skip += top {
+		r := strings.NewReplacer(
+			"{instance}", secret.Instance,
+			"{project}", secret.Project,
+			"{repository}", repo.Repo,
+			"{version}", "1.0",
+			"{baseBranch}", baseBranch,
+			"{targetBranch}", targetBranch,
+			"{top}", strconv.Itoa(top),
+			"{skip}", strconv.Itoa(skip))
+
+		urlString := r.Replace(getCommitsURLTemplate)
+
+		req, err := http.NewRequest("GET", urlString, nil)
+		if err != nil {
+			log.Panic(err)
+		}
+
+		req.SetBasicAuth(secret.Username, secret.Password)
+		resp, err := client.Do(req)
+		if err != nil {
+			log.Panic(err)
+		}
+
+		page := commits{}
+		json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+
+		all.Value = append(all.Value, page.Value...)
+		if len(page.Value) < top {
+			break
+		}
+	}
+	all.Count = len(all.Value)
+	return all
+}
+
+func getCommit(client *http.Client, repo repoConfig, commitID string) commit {
+	getCommitURLTemplate := "https://{instance}/DefaultCollection/{project}/_apis/git/repositories/{repository}/commits/{commitId}?api-version={version}&changeCount={changeCount}"
+	r := strings.NewReplacer(
+		"{instance}", secret.Instance,
+		"{project}", secret.Project,
+		"{repository}", repo.Repo,
+		"{version}", "1.0",
+		"{commitId}", commitID,
+		"{changeCount}", strconv.Itoa(commitChangeCount))
+
+	urlString := r.Replace(getCommitURLTemplate)
+
+	req, err := http.NewRequest("GET", urlString, nil)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	req.SetBasicAuth(secret.Username, secret.Password)
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer resp.Body.Close()
+
+	commit := commit{}
+
+	json.NewDecoder(resp.Body).Decode(&commit)
+	return commit
+}
+
+func completePullRequest(client *http.Client, repo repoConfig, pullRequestID int, commitID string, completion completionOptions) error {
+	patchPullRequestURLTemplate := "https://{instance}/DefaultCollection/{project}/_apis/git/repositories/{repository}/pullRequests/{pullRequest}?api-version={version}"
+
+	r := strings.NewReplacer(
+		"{instance}", secret.Instance,
+		"{project}", secret.Project,
+		"{repository}", repo.Repo,
+		"{pullRequest}", strconv.Itoa(pullRequestID),
+		"{version}", "5.1")
+
+	urlString := r.Replace(patchPullRequestURLTemplate)
+
+	patchPullRequest := patchPullRequest{
+		Status: "completed",
+		LastMergeSourceCommit: lastMergeSourceCommit{
+			CommitID: commitID,
+		},
+		CompletionOptions: completion,
+	}
+
+	body := new(bytes.Buffer)
+	json.NewEncoder(body).Encode(patchPullRequest)
+	req, err := http.NewRequest("PATCH", urlString, body)
+	if err != nil {
+		return err
+	}
+
+	req.SetBasicAuth(secret.Username, secret.Password)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	fmt.Printf("Complete PR %v...\n", pullRequestID)
+	fmt.Println(resp.Status)
+	if resp.StatusCode != http.StatusOK {
+		bodyText, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("complete PR %v: %s %s", pullRequestID, resp.Status, bodyText)
+	}
+	return nil
+}
+
+type policyEvaluations struct {
+	Count int                `json:"count"`
+	Value []policyEvaluation `json:"value"`
+}
+
+type policyEvaluation struct {
+	EvaluationID  string `json:"evaluationId"`
+	Status        string `json:"status"`
+	Configuration struct {
+		ID         int  `json:"id"`
+		IsEnabled  bool `json:"isEnabled"`
+		IsBlocking bool `json:"isBlocking"`
+		Type       struct {
+			DisplayName string `json:"displayName"`
+		} `json:"type"`
+	} `json:"configuration"`
+}
+
+type reviewerVote struct {
+	Vote int `json:"vote"`
+}
+
+func getPolicyEvaluations(client *http.Client, pullRequest gitPullRequest) (policyEvaluations, error) {
+	getEvaluationsURLTemplate := "https://{instance}/DefaultCollection/{project}/_apis/policy/evaluations?api-version={version}&artifactId={artifactId}"
+	r := strings.NewReplacer(
+		"{instance}", secret.Instance,
+		"{project}", secret.Project,
+		"{artifactId}", url.QueryEscape(fmt.Sprintf("vstfs:///CodeReview/CodeReviewId/%s/%v", pullRequest.Repository.Project.ID, pullRequest.PullRequestID)),
+		"{version}", "5.0-preview.1")
+
+	urlString := r.Replace(getEvaluationsURLTemplate)
+
+	req, err := http.NewRequest("GET", urlString, nil)
+	if err != nil {
+		return policyEvaluations{}, err
+	}
+
+	req.SetBasicAuth(secret.Username, secret.Password)
+	resp, err := client.Do(req)
+	if err != nil {
+		return policyEvaluations{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return policyEvaluations{}, fmt.Errorf("get policy evaluations of PR %v: %s", pullRequest.PullRequestID, resp.Status)
+	}
+
+	evaluations := policyEvaluations{}
+	err = json.NewDecoder(resp.Body).Decode(&evaluations)
+	return evaluations, err
+}
+
+// votePullRequest votes on a PR as reviewerID, 10 approves.
+func votePullRequest(client *http.Client, repo repoConfig, pullRequestID int, reviewerID string, vote int) error {
+	putReviewerURLTemplate := "https://{instance}/DefaultCollection/{project}/_apis/git/repositories/{repository}/pullRequests/{pullRequest}/reviewers/{reviewer}?api-version={version}"
+	r := strings.NewReplacer(
+		"{instance}", secret.Instance,
+		"{project}", secret.Project,
+		"{repository}", repo.Repo,
+		"{pullRequest}", strconv.Itoa(pullRequestID),
+		"{reviewer}", reviewerID,
+		"{version}", "3.0")
+
+	urlString := r.Replace(putReviewerURLTemplate)
+
+	body := new(bytes.Buffer)
+	json.NewEncoder(body).Encode(reviewerVote{Vote: vote})
+	req, err := http.NewRequest("PUT", urlString, body)
+	if err != nil {
+		return err
+	}
+
+	req.SetBasicAuth(secret.Username, secret.Password)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		bodyText, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("vote on PR %v: %s %s", pullRequestID, resp.Status, bodyText)
+	}
+	return nil
+}
+
+func abandonPullRequest(client *http.Client, repo repoConfig, pullRequestID int) {
+	patchPullRequestURLTemplate := "https://{instance}/DefaultCollection/{project}/_apis/git/repositories/{repository}/pullRequests/{pullRequest}?api-version={version}"
+
 	r := strings.NewReplacer(
 		"{instance}", secret.Instance,
 		"{project}", secret.Project,
-		"{repository}", secret.Repo,
+		"{repository}", repo.Repo,
+		"{pullRequest}", strconv.Itoa(pullRequestID),
 		"{version}", "3.0-preview")
 
-	urlString := r.Replace(postPullRequestURLTemplate)
+	urlString := r.Replace(patchPullRequestURLTemplate)
 
-	pullRequest := pullRequest{
-		SourceRefName: fmt.Sprintf("%s/%s", "refs/heads", sourceBranch),
-		TargetRefName: fmt.Sprintf("%s/%s", "refs/heads", targetBranch),
-		Title:         title,
-		Description:   description,
+	body := new(bytes.Buffer)
+	json.NewEncoder(body).Encode(pullRequestStatus{Status: "abandoned"})
+	req, err := http.NewRequest("PATCH", urlString, body)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	req.SetBasicAuth(secret.Username, secret.Password)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer resp.Body.Close()
+
+	fmt.Printf("Abandon PR %v...\n", pullRequestID)
+	fmt.Println(resp.Status)
+}
+
+func retargetPullRequest(client *http.Client, repo repoConfig, pullRequestID int, targetBranch string) bool {
+	patchPullRequestURLTemplate := "https://{instance}/DefaultCollection/{project}/_apis/git/repositories/{repository}/pullRequests/{pullRequest}?api-version={version}"
+
+	r := strings.NewReplacer(
+		"{instance}", secret.Instance,
+		"{project}", secret.Project,
+		"{repository}", repo.Repo,
+		"{pullRequest}", strconv.Itoa(pullRequestID),
+		"{version}", "5.1")
+
+	urlString := r.Replace(patchPullRequestURLTemplate)
+
+	body := new(bytes.Buffer)
+	json.NewEncoder(body).Encode(pullRequestTarget{TargetRefName: fmt.Sprintf("%s/%s", "refs/heads", targetBranch)})
+	req, err := http.NewRequest("PATCH", urlString, body)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	req.SetBasicAuth(secret.Username, secret.Password)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer resp.Body.Close()
+
+	fmt.Printf("Retarget PR %v to %s...\n", pullRequestID, targetBranch)
+	fmt.Println(resp.Status)
+	return resp.StatusCode == http.StatusOK
+}
+
+func postCherryPick(client *http.Client, repo repoConfig, ontoBranch string, generatedBranch string, commitIDs []string) cherryPick {
+	postCherryPickURLTemplate := "https://{instance}/DefaultCollection/{project}/_apis/git/repositories/{repository}/cherryPicks?api-version={version}"
+	r := strings.NewReplacer(
+		"{instance}", secret.Instance,
+		"{project}", secret.Project,
+		"{repository}", repo.Repo,
+		"{version}", "5.0")
+
+	urlString := r.Replace(postCherryPickURLTemplate)
+
+	cherryPickReq := cherryPickReq{
+		OntoRefName:      fmt.Sprintf("%s/%s", "refs/heads", ontoBranch),
+		GeneratedRefName: fmt.Sprintf("%s/%s", "refs/heads", generatedBranch),
 	}
+	for _, commitID := range commitIDs {
+		cherryPickReq.Source.CommitList = append(cherryPickReq.Source.CommitList, gitCommitRef{CommitID: commitID})
+	}
+
 	body := new(bytes.Buffer)
-	json.NewEncoder(body).Encode(pullRequest)
+	json.NewEncoder(body).Encode(cherryPickReq)
 	req, err := http.NewRequest("POST", urlString, body)
 	if err != nil {
-		log.Fatal(err)
+		log.Panic(err)
+	}
+
+	req.SetBasicAuth(secret.Username, secret.Password)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer resp.Body.Close()
+
+	fmt.Printf("Cherry-pick %v commits onto %s as %s...\n", len(commitIDs), ontoBranch, generatedBranch)
+	fmt.Println(resp.Status)
+
+	cherryPick := cherryPick{}
+	json.NewDecoder(resp.Body).Decode(&cherryPick)
+	return cherryPick
+}
+
+func getCherryPick(client *http.Client, repo repoConfig, cherryPickID int) cherryPick {
+	getCherryPickURLTemplate := "https://{instance}/DefaultCollection/{project}/_apis/git/repositories/{repository}/cherryPicks/{cherryPickId}?api-version={version}"
+	r := strings.NewReplacer(
+		"{instance}", secret.Instance,
+		"{project}", secret.Project,
+		"{repository}", repo.Repo,
+		"{cherryPickId}", strconv.Itoa(cherryPickID),
+		"{version}", "5.0")
+
+	urlString := r.Replace(getCherryPickURLTemplate)
+
+	req, err := http.NewRequest("GET", urlString, nil)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	req.SetBasicAuth(secret.Username, secret.Password)
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer resp.Body.Close()
+
+	cherryPick := cherryPick{}
+	json.NewDecoder(resp.Body).Decode(&cherryPick)
+	return cherryPick
+}
+
+// cherryPickCommits cherry-picks commitIDs onto ontoBranch as
+// generatedBranch and waits until the operation is over.
+func cherryPickCommits(client *http.Client, repo repoConfig, ontoBranch string, generatedBranch string, commitIDs []string) cherryPick {
+	cherryPick := postCherryPick(client, repo, ontoBranch, generatedBranch, commitIDs)
+	for i := 0; i < 60 && (cherryPick.Status == "queued" || cherryPick.Status == "inProgress"); i++ {
+		time.Sleep(5 * time.Second)
+		cherryPick = getCherryPick(client, repo, cherryPick.CherryPickID)
+	}
+
+	fmt.Printf("Cherry-pick %v: %s\n", cherryPick.CherryPickID, cherryPick.Status)
+	return cherryPick
+}
+
+// waitForPullRequest polls the PR until it is no longer active or timeout
+// passes, and returns its last state.
+func waitForPullRequest(client *http.Client, repo repoConfig, pullRequestID int, timeout time.Duration) gitPullRequest {
+	deadline := time.Now().Add(timeout)
+	pullRequest := getPullRequest(client, repo, pullRequestID)
+	for pullRequest.Status == "active" && time.Now().Before(deadline) {
+		time.Sleep(30 * time.Second)
+		pullRequest = getPullRequest(client, repo, pullRequestID)
+	}
+	return pullRequest
+}
+
+// waitForMergeStatus waits until the merge of a new PR was tried, it
+// cannot be completed before.
+func waitForMergeStatus(client *http.Client, repo repoConfig, pullRequestID int, timeout time.Duration) gitPullRequest {
+	deadline := time.Now().Add(timeout)
+	pullRequest := getPullRequest(client, repo, pullRequestID)
+	for (pullRequest.MergeStatus == "notSet" || pullRequest.MergeStatus == "queued") && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Second)
+		pullRequest = getPullRequest(client, repo, pullRequestID)
+	}
+	return pullRequest
+}
+
+func updateMasterVersion(done chan<- bool, repo repoConfig, scheme versionScheme, relVersion string, relBranch string, posted *postedStatus) {
+	client := &http.Client{}
+
+	target, err := scheme.MasterVersion(relVersion)
+	if err != nil {
+		fmt.Printf("Error release version: %v\n", err)
+		done <- false
+		return
+	}
+
+	build, err := scheme.Build(target)
+	if err != nil {
+		fmt.Printf("Error release version: %v\n", err)
+		done <- false
+		return
+	}
+
+	// check master branch version
+	masterBranch := getMasterBranch(client, repo)
+	versionFile, err := getCommitVersionFile(client, repo, masterBranch.ObjectID)
+	if err != nil {
+		fmt.Printf("Error version file: %v\n", err)
+		done <- false
+		return
+	}
+
+	masterVersion, err := buildVersion(repo, versionFile)
+	if err != nil {
+		fmt.Printf("Error version file: %v\n", err)
+		done <- false
+		return
+	}
+
+	masterBuild, err := scheme.Build(masterVersion.Value)
+	if err != nil {
+		fmt.Printf("Error version file: %v\n", err)
+		done <- false
+		return
+	}
+
+	order, err := scheme.Compare(masterVersion.Value, target)
+	if err != nil {
+		fmt.Printf("Error version file: %v\n", err)
+		done <- false
+		return
 	}
 
-	req.SetBasicAuth(secret.Username, secret.Password)
-	req.Header.Set("Content-Type", "application/json")
+	if build == masterBuild {
+		fmt.Printf("%s branch is already version: %s\n", repo.MasterBranch, masterVersion.Value)
+		done <- true
+		return
+	}
+	if order > 0 {
+		fmt.Printf("%s branch version %s is ahead of %s\n", repo.MasterBranch, masterVersion.Value, target)
+		done <- true
+		return
+	}
 
-	resp, err := client.Do(req)
+	var values []version
+	comment := fmt.Sprintf("%s\n\n%s: %s", versionResetComment, versionResetTrailer, relBranch)
+	if target != relVersion {
+		// master moves on to its own version instead of the release one
+		values, err = advancedVersions(repo, scheme, versionFile, build)
+		comment = fmt.Sprintf("Advance version to %s for next release\n\n%s: %s", build, versionResetTrailer, relBranch)
+	} else {
+		values, err = releaseVersions(client, repo, relBranch)
+	}
 	if err != nil {
-		log.Fatal(err)
+		fmt.Printf("Error version file: %v\n", err)
+		done <- false
+		return
 	}
-	defer resp.Body.Close()
 
-	fmt.Printf("Starting PR from %s to %s...\n", sourceBranch, targetBranch)
-	fmt.Println(resp.Status)
+	done <- mergeReleaseVersion(client, repo, target, relBranch, masterBranch.ObjectID, versionFile, values, comment, posted)
 }
 
-func getDiffsBetweenBranches(client *http.Client, baseBranch string, targetBranch string) diffs {
-	getDiffsURLTemplate := "https://{instance}/DefaultCollection/{project}/_apis/git/repositories/{repository}/diffs/commits?api-version={version}&targetVersionType=branch&targetVersion={targetBranch}&baseVersionType=branch&baseVersion={baseBranch}"
-	r := strings.NewReplacer(
-		"{instance}", secret.Instance,
-		"{project}", secret.Project,
-		"{repository}", secret.Repo,
-		"{version}", "1.0",
-		"{baseBranch}", baseBranch,
-		"{targetBranch}", targetBranch)
-
-	urlString := r.Replace(getDiffsURLTemplate)
-
-	req, err := http.NewRequest("GET", urlString, nil)
+// releaseVersions returns the versions reset on relBranch, which master
+// takes over.
+func releaseVersions(client *http.Client, repo repoConfig, relBranch string) ([]version, error) {
+	relFile, err := getBranchVersionFile(client, repo, relBranch)
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("%s: %v", relBranch, err)
 	}
+	return resetVersions(repo, relFile)
+}
 
-	req.SetBasicAuth(secret.Username, secret.Password)
-	resp, err := client.Do(req)
+// advancedVersions returns the versions of master cut for build, the
+// train after the release.
+func advancedVersions(repo repoConfig, scheme versionScheme, versionFile versionFile, build string) ([]version, error) {
+	resets, err := resetVersions(repo, versionFile)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	defer resp.Body.Close()
-
-	diffs := diffs{}
-
-	json.NewDecoder(resp.Body).Decode(&diffs)
 
-	return diffs
+	values := []version{}
+	for _, current := range resets {
+		value, err := scheme.Release(current.Value, build)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Printf("Advance %s version %s to: %s\n", repo.MasterBranch, current.Name, value)
+		values = append(values, version{Name: current.Name, Value: value})
+	}
+	return values, nil
 }
 
-func getCommit(client *http.Client, commitID string) commit {
-	getCommitURLTemplate := "https://{instance}/DefaultCollection/{project}/_apis/git/repositories/{repository}/commits/{commitId}?api-version={version}&changeCount={changeCount}"
-	r := strings.NewReplacer(
-		"{instance}", secret.Instance,
-		"{project}", secret.Project,
-		"{repository}", secret.Repo,
-		"{version}", "1.0",
-		"{commitId}", commitID,
-		"changeCount", "100")
+// versionTopicBranch is the short-lived branch carrying the release
+// version from master into the PR, so commits made on the release branch
+// meanwhile do not block it.
+func versionTopicBranch(relBranch string) string {
+	return fmt.Sprintf("version/%s", relBranch)
+}
 
-	urlString := r.Replace(getCommitURLTemplate)
+// mergeReleaseVersion sets values in the master version file on a topic
+// branch from master and merges it by PR, bringing master to target
+// after relBranch was cut. The topic branch is deleted when the PR
+// completes.
+func mergeReleaseVersion(client *http.Client, repo repoConfig, target string, relBranch string, masterCommitID string, versionFile versionFile, values []version, comment string, posted *postedStatus) bool {
+	topicBranch := versionTopicBranch(relBranch)
 
-	req, err := http.NewRequest("GET", urlString, nil)
+	masterVersion, err := buildVersion(repo, versionFile)
 	if err != nil {
-		log.Fatal(err)
+		fmt.Printf("Error version file: %v\n", err)
+		return false
 	}
 
-	req.SetBasicAuth(secret.Username, secret.Password)
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Fatal(err)
+	topicRef := ref{}
+	for _, b := range getRelBranches(client, repo, topicBranch).Value {
+		if b.Name == fmt.Sprintf("%s/%s", "refs/heads", topicBranch) {
+			topicRef = b
+		}
 	}
-	defer resp.Body.Close()
 
-	commit := commit{}
+	if topicRef.ObjectID == "" {
+		createBranch(client, repo, topicBranch, masterCommitID)
+	} else if getDiffsBetweenBranches(client, repo, repo.MasterBranch, topicBranch).AheadCount == 0 {
+		// an earlier run died before pushing, start over from master
+		if !updateRef(client, repo, fmt.Sprintf("%s/%s", "refs/heads", topicBranch), topicRef.ObjectID, masterCommitID) {
+			fmt.Printf("Failed to move %s to %s\n", topicBranch, masterCommitID)
+			return false
+		}
+		topicRef.ObjectID = ""
+	}
 
-	json.NewDecoder(resp.Body).Decode(&commit)
-	return commit
-}
+	if topicRef.ObjectID == "" {
+		for _, v := range values {
+			if err := versionFile.SetVersion(v.Name, v.Value); err != nil {
+				fmt.Printf("Error version file: %v\n", err)
+				return false
+			}
+		}
 
-func completePullRequest(client *http.Client, pullRequestID int, commitID string, mergeMessage string, bypassPolicy bool, deleteSourceBranch bool) {
-	patchPullRequestURLTemplate := "https://{instance}/DefaultCollection/{project}/_apis/git/repositories/{repository}/pullRequests/{pullRequest}?api-version={version}"
+		synced, err := releaseSyncChanges(client, repo, relBranch)
+		if err != nil {
+			fmt.Printf("Error sync paths: %v\n", err)
+			return false
+		}
 
-	r := strings.NewReplacer(
-		"{instance}", secret.Instance,
-		"{project}", secret.Project,
-		"{repository}", secret.Repo,
-		"{pullRequest}", strconv.Itoa(pullRequestID),
-		"{version}", "3.0-preview")
+		if pushVersionChanges(client, repo, versionFile, topicBranch, masterCommitID, comment, synced) == "" {
+			fmt.Printf("Failed to push version to %s\n", topicBranch)
+			return false
+		}
+	}
 
-	urlString := r.Replace(patchPullRequestURLTemplate)
+	// check PR
+	options := withReleaseMessage(repo.PullRequestOptions["version"], target, relBranch)
+	// the topic branch goes with the PR, also when auto-complete merges it
+	options.DeleteSourceBranch = true
+	pullRequest, found := reconcileVersionPullRequests(client, repo, relBranch)
+	if !found {
+		options.Labels = append(append([]string{}, options.Labels...), toolLabel)
+		description := fmt.Sprintf("%s\n\n%s", versionResetComment, versionPullRequestMarker(relBranch))
+		created, err := submitPullRequest(client, repo, topicBranch, repo.MasterBranch, versionResetComment, description, options)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return false
+		}
+		pullRequest = created
+	}
 
-	patchPullRequest := patchPullRequest{
-		Status: "completed",
-		LastMergeSourceCommit: lastMergeSourceCommit{
-			CommitID: commitID,
-		},
-		CompletionOptions: completionOptions{
-			MergeCommitMessage: mergeMessage,
-			SquashMerge:        strconv.FormatBool(true),
-			DeleteSourceBranch: strconv.FormatBool(deleteSourceBranch),
-			BypassPolicy:       strconv.FormatBool(bypassPolicy),
-		},
+	// check diff
+	diffs := getDiffsBetweenBranches(client, repo, repo.MasterBranch, topicBranch)
+
+	if diffs.AheadCount != 1 {
+		fmt.Printf("Cannot merge PR from %s to %s\n", topicBranch, repo.MasterBranch)
+		fmt.Printf("Diff between %s and %s, %+v\n", repo.MasterBranch, topicBranch, diffs)
+		return false
 	}
 
-	body := new(bytes.Buffer)
-	json.NewEncoder(body).Encode(patchPullRequest)
-	req, err := http.NewRequest("PATCH", urlString, body)
-	if err != nil {
-		log.Fatal(err)
+	if !diffs.AllChangesIncluded {
+		fmt.Printf("Diff between %s and %s is too large to check\n", repo.MasterBranch, topicBranch)
+		return false
 	}
 
-	req.SetBasicAuth(secret.Username, secret.Password)
-	req.Header.Set("Content-Type", "application/json")
+	offending := []string{}
+	for _, change := range diffs.Changes {
+		if change.Item.IsFolder {
+			continue
+		}
+		allowed, err := syncPathAllowed(repo, change.Item.Path)
+		if err != nil {
+			fmt.Printf("Error sync paths: %v\n", err)
+			return false
+		}
+		if !allowed {
+			offending = append(offending, change.Item.Path)
+		}
+	}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Fatal(err)
+	if len(offending) > 0 {
+		fmt.Printf("Branch %s has changes not allowed on %s:\n  %s\n", topicBranch, repo.MasterBranch, strings.Join(offending, "\n  "))
+		return false
 	}
-	defer resp.Body.Close()
 
-	fmt.Printf("Complete PR %v...\n", pullRequestID)
-	fmt.Println(resp.Status)
-}
+	status := prStatus{
+		Action:        "Merge the release version back into " + repo.MasterBranch,
+		RelBranch:     relBranch,
+		VersionBefore: masterVersion.Value,
+		VersionAfter:  target,
+		Commits:       []string{diffs.TargetCommit},
+	}
 
-func updateMasterVersion(done chan<- bool, build string, relBranch string) {
-	client := &http.Client{}
+	if pullRequest.IsDraft || options.AutoComplete {
+		fmt.Printf("PR %v is left to complete by auto-complete or by hand.\n", pullRequest.PullRequestID)
+		postStatus(client, repo, pullRequest.PullRequestID, status)
+		*posted = postedStatus{PullRequestID: pullRequest.PullRequestID, Status: status}
+		return true
+	}
 
-	// check master branch version
-	versionXML := getBranchVersionXML(client, secret.MasterBranch)
+	pullRequest = waitForMergeStatus(client, repo, pullRequest.PullRequestID, 5*time.Minute)
+	if pullRequest.MergeStatus != "succeeded" {
+		fmt.Printf("Cannot merge PR %v, merge status: %s\n", pullRequest.PullRequestID, pullRequest.MergeStatus)
+		return false
+	}
 
-	if len(versionXML.Versions) != 1 {
-		fmt.Printf("Error version xml: %+v\n", versionXML)
-		done <- false
-		return
+	// complete PR, removing the topic branch
+	completed := finishPullRequest(client, repo, pullRequest, diffs.TargetCommit, options)
+	if completed {
+		status.Action += ", completed by the tool"
 	}
+	postStatus(client, repo, pullRequest.PullRequestID, status)
+	*posted = postedStatus{PullRequestID: pullRequest.PullRequestID, Status: status}
+	return completed
+}
 
-	versions := strings.Split(versionXML.Versions[0].Value, ".")
-	if build != versions[len(versions)-2] {
-		// check PR
-		pullRequests := getPullRequests(client, secret.MasterBranch, relBranch)
+// waitForBuildDefinitions polls the build definitions of relBranch with
+// backoff until the onboarding build created one. It gives up when the
+// onboarding build fails or the deadline passes.
+func waitForBuildDefinitions(client *http.Client, repo repoConfig, relBranch string, onboardBuildID int) (definitions, error) {
+	interval := time.Duration(repo.DefinitionPollInitialSeconds) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	maxInterval := time.Duration(repo.DefinitionPollMaxSeconds) * time.Second
+	if maxInterval <= 0 {
+		maxInterval = time.Minute
+	}
+	timeout := time.Duration(repo.DefinitionPollTimeoutMinutes) * time.Minute
+	if timeout <= 0 {
+		timeout = 5 * time.Minute
+	}
 
-		if pullRequests.Count == 0 {
-			// submit PR
-			submitPullRequest(client, relBranch, secret.MasterBranch, "Reset version for release", "Reset version for release")
-			time.Sleep(10 * time.Second)
-			pullRequests = getPullRequests(client, secret.MasterBranch, relBranch)
-		}
+	start := time.Now()
+	deadline := start.Add(timeout)
+	for {
+		time.Sleep(interval)
 
-		if pullRequests.Count == 0 {
-			fmt.Println("Error: No PR found after submit PR.")
-			done <- false
-			return
+		defs := getBuildDefinitions(client, repo, relBranch)
+		if defs.Count >= 1 {
+			fmt.Printf("Found build definitions after %v: %v\n", time.Since(start).Round(time.Second), defs.Count)
+			return defs, nil
 		}
 
-		if pullRequests.Count > 1 {
-			fmt.Printf("Error: %v PRs found. PR IDs:", pullRequests.Count)
-			for _, pr := range pullRequests.Value {
-				fmt.Printf("%v, ", pr.PullRequestID)
-			}
-			done <- false
-			return
+		onboardBuild := getBuild(client, onboardBuildID)
+		fmt.Printf("Onboarding build %v: %s %s\n", onboardBuildID, onboardBuild.Status, onboardBuild.Result)
+		if onboardBuild.Status == "completed" && onboardBuild.Result != "succeeded" && onboardBuild.Result != "partiallySucceeded" {
+			return defs, fmt.Errorf("onboarding build %v %s", onboardBuildID, onboardBuild.Result)
 		}
 
-		// check diff
-		diffs := getDiffsBetweenBranches(client, secret.MasterBranch, relBranch)
-
-		if diffs.BehindCount != 0 || diffs.AheadCount != 1 {
-			fmt.Printf("Cannot merge PR from %s to %s\n", relBranch, secret.MasterBranch)
-			fmt.Printf("Diff between %s and %s, %+v\n", secret.MasterBranch, relBranch, diffs)
-			done <- false
-			return
+		if !time.Now().Before(deadline) {
+			return defs, fmt.Errorf("no build definitions for %s after %v", relBranch, timeout)
 		}
 
-		path := ""
-		for _, change := range diffs.Changes {
-			if !strings.HasPrefix(secret.VersionPath, change.Item.Path) {
-				path = change.Item.Path
-				break
-			}
+		interval *= 2
+		if interval > maxInterval {
+			interval = maxInterval
 		}
-
-		if path != "" {
-			fmt.Printf("Branch %s has change other than version file: %s\n", relBranch, path)
-			done <- false
-			return
+		if remaining := time.Until(deadline); interval > remaining {
+			interval = remaining
 		}
-
-		// complete PR
-		completePullRequest(client, pullRequests.Value[0].PullRequestID, diffs.TargetCommit, pullRequests.Value[0].Title, true, false)
-	} else {
-		fmt.Printf("%s branch is already version: %s\n", secret.MasterBranch, versionXML.Versions[0].Value)
 	}
-	done <- true
 }
 
-func startBuild(done chan bool, relBranch string) {
+// startBuild makes sure relBranch has a build definition and a build,
+// setting buildID to the build it queued.
+func startBuild(done chan bool, repo repoConfig, relBranch string, buildID *int) {
 	client := &http.Client{}
 
 	// check build definition
-	defs := getBuildDefinitions(client, relBranch)
+	defs := getBuildDefinitions(client, repo, relBranch)
 
 	fmt.Printf("Found build definitions: %v\n", defs.Count)
 
 	if defs.Count < 1 {
 		// create build definition
-		onboardBuildDefinition(client, relBranch)
-
-		i := 0
-		for ; i < 10; i++ {
-			time.Sleep(30 * time.Second)
-			defs = getBuildDefinitions(client, relBranch)
-			fmt.Printf("%v\n", defs.Count)
-			if defs.Count >= 1 {
-				break
-			}
+		onboardBuildID := onboardBuildDefinition(client, repo, relBranch)
+		if onboardBuildID == 0 {
+			fmt.Printf("Onboarding build for %s was not queued\n", relBranch)
+			done <- false
+			return
 		}
 
-		if i >= 10 {
-			fmt.Printf("No build definitions after %v seconds...\n", i*30)
+		var err error
+		defs, err = waitForBuildDefinitions(client, repo, relBranch, onboardBuildID)
+		if err != nil {
+			fmt.Printf("Error build definition: %v\n", err)
 			done <- false
 			return
 		}
@@ -913,7 +2434,7 @@ func startBuild(done chan bool, relBranch string) {
 
 	buildDefID := defs.Value[0].ID
 	for _, def := range defs.Value {
-		if def.Name == secret.DefinitionName {
+		if def.Name == repo.DefinitionName {
 			buildDefID = def.ID
 			break
 		}
@@ -926,121 +2447,309 @@ func startBuild(done chan bool, relBranch string) {
 	fmt.Printf("Found build: %v\n", builds.Count)
 	if builds.Count < 1 {
 		// create build
-		postBuild(client, relBranch, buildDefID)
+		*buildID = postBuild(client, relBranch, buildDefID)
+		if *buildID == 0 {
+			fmt.Printf("Build for %s was not queued\n", relBranch)
+			done <- false
+			return
+		}
 	}
 
 	done <- true
 }
 
-func bumpBuildNum(build string) string {
-	buildNum, err := strconv.Atoi(build)
-	if err != nil {
-		log.Fatal(err)
-	}
-	return strconv.Itoa(buildNum + 1)
-}
-
-func main() {
-	// read secrets
-	secretPathString := os.Getenv("SECRET_PATH")
-	if len(secretPathString) == 0 {
-		fmt.Println("env SECRET_PATH not found.")
-		return
-	}
-
-	file, _ := os.Open(secretPathString)
-	defer file.Close()
-	decoder := json.NewDecoder(file)
-	err := decoder.Decode(&secret)
-	if err != nil {
-		log.Fatal(err)
-	}
-	fmt.Printf("Secret from env var: %s\n", secret.Username)
-
-	branchDayPtr := flag.Int("branchDay", 5, "The day of week to branch")
-
-	flag.Parse()
-
-	if *branchDayPtr < 0 || *branchDayPtr > 6 {
-		fmt.Println("-branchDay should between 0 and 6")
-		return
-	}
-
+func cutRelease(repo repoConfig, branchDay int, releaseDate time.Time) cutResult {
 	client := &http.Client{}
 
 	// check branch
-	commitID := "0000000000000000000000000000000000000000"
+	commitID := zeroObjectID
 
-	n := time.Now()
-	releaseDate := n.AddDate(0, 0, (*branchDayPtr-7-int(n.Weekday()))%7)
-	y, m, d := releaseDate.Date()
-	relBranch := fmt.Sprintf("%s%v%02v%02v", secret.ReleaseBranchPrefix, y, int(m), d)
-	fmt.Println(relBranch)
+	relBranch := releaseBranchName(repo, releaseDate)
+	fmt.Printf("%s: %s\n", repo.Repo, relBranch)
+
+	result := cutResult{
+		Repo:   repo.Repo,
+		Branch: relBranch,
+	}
 
-	relBranches := getRelBranches(client, relBranch)
+	forkCommitID := ""
+	relBranches := getRelBranches(client, repo, relBranch)
 	fmt.Printf("release branches: %v\n", relBranches.Count)
 	if relBranches.Count > 0 {
 		fmt.Println("release branch exists.")
 		commitID = relBranches.Value[0].ObjectID
 	} else {
 		// fork
-		masterBranch := getMasterBranch(client)
+		masterBranch := getMasterBranch(client, repo)
 
-		createBranch(client, relBranch, masterBranch.ObjectID)
+		createBranch(client, repo, relBranch, masterBranch.ObjectID)
 		commitID = masterBranch.ObjectID
+		forkCommitID = masterBranch.ObjectID
 	}
 
-	// check version
-	versionXML := getBranchVersionXML(client, relBranch)
+	supersedePullRequests(client, repo, relBranch, commitID)
 
-	if len(versionXML.Versions) != 1 {
-		fmt.Printf("Error version xml: %+v\n", versionXML)
-		return
+	// check version
+	scheme, err := newVersionScheme(repo, releaseDate)
+	if err != nil {
+		fmt.Printf("Error version scheme: %v\n", err)
+		return result
 	}
 
-	versions := strings.Split(versionXML.Versions[0].Value, ".")
-	build := versions[len(versions)-2]
-
-	fmt.Printf("%s branch is at: %s\n", relBranch, versionXML.Versions[0].Value)
+	versionFile, err := getBranchVersionFile(client, repo, relBranch)
+	if err != nil {
+		fmt.Printf("Error version file: %v\n", err)
+		return result
+	}
 
-	if versions[len(versions)-1] != "0" {
-		resetted := false
-		// check commits
-		n = time.Now()
-		daysLookBack := (*branchDayPtr-7-int(n.Weekday()))%7 - 2
+	relVersion, err := buildVersion(repo, versionFile)
+	if err != nil {
+		fmt.Printf("Error version file: %v\n", err)
+		return result
+	}
 
-		commits := getCommits(client, relBranch, n.AddDate(0, 0, daysLookBack), n)
-		fmt.Println(commits.Count)
+	build, err := scheme.Build(relVersion.Value)
+	if err != nil {
+		fmt.Printf("Error version file: %v\n", err)
+		return result
+	}
 
-		for _, commit := range commits.Value {
-			versionXML := getCommitVersionXML(client, commit.CommitID)
+	fmt.Printf("%s branch is at: %s\n", relBranch, relVersion.Value)
 
-			if len(versionXML.Versions) != 1 {
-				fmt.Printf("Found more than one version, commit %s: %+v\n", commit.CommitID, versionXML)
-			}
+	isRelease, err := scheme.IsRelease(relVersion.Value)
+	if err != nil {
+		fmt.Printf("Error version file: %v\n", err)
+		return result
+	}
 
-			versions = strings.Split(versionXML.Versions[0].Value, ".")
-			if versions[len(versions)-2] != build {
-				fmt.Printf("Found version before fork: Commit %s: %+v\n", commit.CommitID, versionXML.Versions[0].Value)
-				resetted = true
-				break
+	releaseVersion := relVersion.Value
+	if !isRelease {
+		resetted := false
+		if repo.ResetDetection == "history" {
+			resetted = scanVersionHistory(client, repo, scheme, relBranch, build, branchDay)
+		} else {
+			resetted, err = versionResetDone(client, repo, scheme, relBranch, build)
+			if err != nil {
+				fmt.Printf("Error version reset detection: %v\n", err)
+				return result
 			}
 		}
+
 		if !resetted {
-			fmt.Printf("No version reset found in %v days.\n", daysLookBack)
+			fmt.Printf("No version reset found in %s.\n", relBranch)
 
 			// reset version
-			build = bumpBuildNum(build)
-			resetBuildVersion(client, versionXML, build, relBranch, commitID)
+			build, err = scheme.NextBuild(build)
+			if err != nil {
+				fmt.Printf("Error version file: %v\n", err)
+				return result
+			}
+			releaseVersion, err = resetBuildVersion(client, repo, scheme, versionFile, build, relBranch, commitID)
+			if err != nil {
+				fmt.Printf("Error reset version: %v\n", err)
+				return result
+			}
 		}
 	}
 
+	tagsDone := true
+	if repo.CreateReleaseTags {
+		tagsDone = createReleaseTags(client, repo, relBranch, forkCommitID, releaseVersion)
+	}
+
+	// each goroutine writes its result before it reports done
+	var versionStatus postedStatus
+	var buildID int
 	uChan := make(chan bool)
 	sChan := make(chan bool)
-	go updateMasterVersion(uChan, build, relBranch)
-	go startBuild(sChan, relBranch)
+	go func() {
+		defer recoverDone(uChan, repo, "update master version")
+		updateMasterVersion(uChan, repo, scheme, releaseVersion, relBranch, &versionStatus)
+	}()
+	go func() {
+		defer recoverDone(sChan, repo, "start build")
+		startBuild(sChan, repo, relBranch, &buildID)
+	}()
 	uDone := <-uChan
 	sDone := <-sChan
-	fmt.Printf("update master version succeeded: %v\n", uDone)
-	fmt.Printf("start build succeeded: %v\n", sDone)
+	fmt.Printf("%s: update master version succeeded: %v\n", repo.Repo, uDone)
+	fmt.Printf("%s: start build succeeded: %v\n", repo.Repo, sDone)
+
+	// the version PR shows the build of the release it was opened for
+	if versionStatus.PullRequestID != 0 && buildID != 0 {
+		versionStatus.Status.BuildID = buildID
+		postStatus(client, repo, versionStatus.PullRequestID, versionStatus.Status)
+	}
+
+	result.Succeeded = uDone && sDone && tagsDone
+	return result
+}
+
+// releaseBranchName is the release branch of repo cut for releaseDate.
+func releaseBranchName(repo repoConfig, releaseDate time.Time) string {
+	y, m, d := releaseDate.Date()
+	return fmt.Sprintf("%s%v%02v%02v", repo.ReleaseBranchPrefix, y, int(m), d)
+}
+
+// releaseBranchDate is the release date relBranch of repo was cut for, the
+// reverse of releaseBranchName.
+func releaseBranchDate(repo repoConfig, relBranch string) (time.Time, error) {
+	if !strings.HasPrefix(relBranch, repo.ReleaseBranchPrefix) {
+		return time.Time{}, fmt.Errorf("%s is not a release branch of %s", relBranch, repo.Repo)
+	}
+	date, err := time.ParseInLocation("20060102", strings.TrimPrefix(relBranch, repo.ReleaseBranchPrefix), time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s is not a release branch of %s: %v", relBranch, repo.Repo, err)
+	}
+	return date, nil
+}
+
+// recoverDone reports a panic of a step of the cut of repo as a failure
+// on done, so the other steps and repositories go on. It must be
+// deferred by the goroutine running the step.
+func recoverDone(done chan<- bool, repo repoConfig, step string) {
+	if r := recover(); r != nil {
+		fmt.Printf("%s: %s panicked: %v\n%s\n", repo.Repo, step, r, debug.Stack())
+		done <- false
+	}
+}
+
+// cutReleaseRecovered cuts repo like cutRelease, recording a panic as a
+// failed cut instead of ending the release train.
+func cutReleaseRecovered(repo repoConfig, branchDay int, releaseDate time.Time) (result cutResult) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Printf("%s: cut panicked: %v\n%s\n", repo.Repo, r, debug.Stack())
+			result = cutResult{
+				Repo:   repo.Repo,
+				Branch: releaseBranchName(repo, releaseDate),
+			}
+		}
+	}()
+	return cutRelease(repo, branchDay, releaseDate)
+}
+
+func cutReleaseTrain(branchDay int) {
+	n := time.Now()
+	releaseDate := n.AddDate(0, 0, (branchDay-7-int(n.Weekday()))%7)
+
+	repos := secret.repositories()
+	workers := secret.MaxParallelRepos
+	if workers < 1 || workers > len(repos) {
+		workers = len(repos)
+	}
+
+	// cut all repositories of the release train with a bounded worker pool
+	jobs := make(chan int)
+	results := make([]cutResult, len(repos))
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = cutReleaseRecovered(repos[i], branchDay, releaseDate)
+			}
+		}()
+	}
+	for i := range repos {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	failed := 0
+	fmt.Println("Release train summary:")
+	for _, result := range results {
+		fmt.Printf("  %s (%s): succeeded: %v\n", result.Repo, result.Branch, result.Succeeded)
+		if !result.Succeeded {
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		fmt.Printf("%v of %v repositories failed.\n", failed, len(results))
+		if secret.FailOnPartialFailure || failed == len(results) {
+			os.Exit(1)
+		}
+	}
+}
+
+func main() {
+	// read secrets
+	secretPathString := os.Getenv("SECRET_PATH")
+	if len(secretPathString) == 0 {
+		fmt.Println("env SECRET_PATH not found.")
+		return
+	}
+
+	file, _ := os.Open(secretPathString)
+	defer file.Close()
+	decoder := json.NewDecoder(file)
+	err := decoder.Decode(&secret)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Secret from env var: %s\n", secret.Username)
+	for _, repo := range secret.repositories() {
+		if err := checkVersionNames(repo); err != nil {
+			fmt.Println(err)
+			os.Exit(2)
+		}
+	}
+
+	branchDayPtr := flag.Int("branchDay", 5, "The day of week to branch")
+	revertMasterPtr := flag.Bool("revertMaster", false, "rollback: also revert the version change merged to master")
+	repoPtr := flag.String("repo", "", "hotfix, mergeback: the repository, if more than one is configured")
+	mergeTimeoutPtr := flag.Duration("mergeTimeout", time.Hour, "hotfix: how long to wait for the PR to merge")
+	excludePtr := flag.String("exclude", "", "mergeback: comma separated release commits which already have an equivalent on master")
+	formatPtr := flag.String("format", "markdown", "gaps: report format, markdown or csv")
+	outputPtr := flag.String("output", "", "gaps: file to write the report to, stdout if empty")
+
+	flag.Parse()
+
+	switch flag.Arg(0) {
+	case "", "cut":
+		if *branchDayPtr < 0 || *branchDayPtr > 6 {
+			fmt.Println("-branchDay should between 0 and 6")
+			return
+		}
+
+		cutReleaseTrain(*branchDayPtr)
+	case "rollback":
+		if flag.NArg() != 2 {
+			fmt.Println("usage: vsts-branch [-revertMaster] rollback <yyyymmdd>")
+			os.Exit(2)
+		}
+
+		// the release date, the suffix of the release branch in every repository
+		releaseDate, err := time.ParseInLocation("20060102", flag.Arg(1), time.Local)
+		if err != nil {
+			fmt.Printf("rollback: %s is not a release date yyyymmdd: %v\n", flag.Arg(1), err)
+			os.Exit(2)
+		}
+
+		rollbackReleaseTrain(releaseDate, *revertMasterPtr)
+	case "hotfix":
+		if flag.NArg() < 3 {
+			fmt.Println("usage: vsts-branch [-repo name] [-mergeTimeout 1h] hotfix <branch> <commit|PR>...")
+			os.Exit(2)
+		}
+
+		runHotfix(*repoPtr, flag.Arg(1), flag.Args()[2:], *mergeTimeoutPtr)
+	case "backport":
+		runBackport()
+	case "mergeback":
+		if flag.NArg() != 2 {
+			fmt.Println("usage: vsts-branch [-repo name] [-exclude commit,...] mergeback <branch>")
+			os.Exit(2)
+		}
+
+		runMergeBack(*repoPtr, flag.Arg(1), *excludePtr)
+	case "gaps":
+		runGapReport(*formatPtr, *outputPtr)
+	default:
+		fmt.Printf("unknown command: %s\n", flag.Arg(0))
+		os.Exit(2)
+	}
 }
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+func runMergeBack(repoName string, relBranch string, exclude string) {
+	repo, ok := selectRepo(repoName)
+	if !ok {
+		fmt.Println("Use -repo to choose one of the configured repositories.")
+		os.Exit(2)
+	}
+
+	excluded := map[string]bool{}
+	for _, commitID := range strings.Split(exclude, ",") {
+		if commitID = strings.TrimSpace(commitID); commitID != "" {
+			excluded[strings.ToLower(commitID)] = true
+		}
+	}
+
+	if !mergeBackRelease(repo, relBranch, excluded) {
+		os.Exit(1)
+	}
+}
+
+// hotfixVersionPattern matches the version commit runHotfix pushes, titled
+// "Hotfix <version> for release <branch>".
+func hotfixVersionPattern(relBranch string) *regexp.Regexp {
+	return regexp.MustCompile(`^Hotfix \S+ for release ` + regexp.QuoteMeta(relBranch) + `$`)
+}
+
+// releaseOnlyCommit tells why a commit of relBranch is left out of the
+// merge-back, or "" if it should go to master.
+func releaseOnlyCommit(relBranch string, comment string, parents []string) string {
+	switch {
+	case len(parents) > 1:
+		return "merge commit"
+	case strings.HasPrefix(comment, versionResetComment), hotfixVersionPattern(relBranch).MatchString(strings.TrimRight(comment, "\n")):
+		return "release version change"
+	case strings.HasPrefix(comment, fmt.Sprintf("[%s] ", relBranch)):
+		return "backport from master"
+	}
+	return ""
+}
+
+// mergeBackRelease cherry-picks the commits made on relBranch since it
+// forked from master onto a topic branch and opens a PR into master. The
+// version changes of the release, backports and commits whose patch id
+// matches a commit on master are left out, as are excluded commits. A
+// commit with the same message as one on master but another patch id, or
+// with too many changes to compare, is merged back and listed as a
+// candidate for -exclude.
+func mergeBackRelease(repo repoConfig, relBranch string, excluded map[string]bool) bool {
+	client := &http.Client{}
+	ctx := context.Background()
+
+	diffs := getDiffsBetweenBranches(client, repo, repo.MasterBranch, relBranch)
+	if diffs.AheadCount == 0 {
+		fmt.Printf("%s: %s has no commits which are not in %s.\n", repo.Repo, relBranch, repo.MasterBranch)
+		return true
+	}
+	fmt.Printf("%s: %s is %v commits ahead of %s, forked at %s\n", repo.Repo, relBranch, diffs.AheadCount, repo.MasterBranch, diffs.CommonCommit)
+
+	masterComments := map[string]bool{}
+	masterPatchIDs := map[string]bool{}
+	for _, c := range getCommitsBetweenBranches(client, repo, relBranch, repo.MasterBranch).Value {
+		if len(c.Parents) > 1 {
+			continue
+		}
+		masterComments[c.Comment] = true
+		patchID, truncated, err := commitPatchID(ctx, client, repo, c.CommitID)
+		if err != nil {
+			fmt.Printf("Error patch id of %s: %v\n", c.CommitID, err)
+			return false
+		}
+		if !truncated {
+			masterPatchIDs[patchID] = true
+		}
+	}
+
+	included := []string{}
+	summary := []string{}
+	skipped := []string{}
+	candidates := []string{}
+	relCommits := getCommitsBetweenBranches(client, repo, repo.MasterBranch, relBranch)
+	// oldest first, so the cherry-picks apply in order
+	for i := len(relCommits.Value) - 1; i >= 0; i-- {
+		c := relCommits.Value[i]
+		subject := strings.SplitN(c.Comment, "\n", 2)[0]
+		reason := releaseOnlyCommit(relBranch, c.Comment, c.Parents)
+		if excluded[strings.ToLower(c.CommitID)] {
+			reason = "excluded"
+		}
+		if reason == "" {
+			patchID, truncated, err := commitPatchID(ctx, client, repo, c.CommitID)
+			if err != nil {
+				fmt.Printf("Error patch id of %s: %v\n", c.CommitID, err)
+				return false
+			}
+			switch {
+			case truncated:
+				candidates = append(candidates, fmt.Sprintf("%s %s (more than %v changes, not compared)", c.CommitID, subject, commitChangeCount))
+			case masterPatchIDs[patchID]:
+				reason = "same change on master"
+			case masterComments[c.Comment]:
+				candidates = append(candidates, fmt.Sprintf("%s %s (same message on %s)", c.CommitID, subject, repo.MasterBranch))
+			}
+		}
+		if reason != "" {
+			fmt.Printf("Skip %s (%s): %s\n", c.CommitID, reason, subject)
+			skipped = append(skipped, fmt.Sprintf("%s %s (%s)", c.CommitID, subject, reason))
+			continue
+		}
+		fmt.Printf("Merge back %s: %s\n", c.CommitID, subject)
+		included = append(included, c.CommitID)
+		summary = append(summary, fmt.Sprintf("%s %s", c.CommitID, subject))
+	}
+
+	if len(candidates) > 0 {
+		fmt.Printf("These commits may already be on %s, -exclude them if so:\n  %s\n", repo.MasterBranch, strings.Join(candidates, "\n  "))
+	}
+
+	if len(included) == 0 {
+		fmt.Printf("Nothing to merge back from %s.\n", relBranch)
+		return true
+	}
+
+	topicBranch := fmt.Sprintf("mergeback/%s-%s", relBranch, time.Now().Format("20060102150405"))
+	cherryPick := cherryPickCommits(client, repo, repo.MasterBranch, topicBranch, included)
+	if cherryPick.Status != "completed" {
+		fmt.Printf("Cherry-pick onto %s failed, conflict: %v, %s\n", repo.MasterBranch, cherryPick.DetailedStatus.Conflict, cherryPick.DetailedStatus.FailureMessage)
+		if cherryPick.DetailedStatus.Conflict {
+			if conflicts := mergeBackConflicts(client, repo, diffs.CommonCommit, included); len(conflicts) > 0 {
+				fmt.Printf("Files changed on both %s and %s:\n  %s\n", relBranch, repo.MasterBranch, strings.Join(conflicts, "\n  "))
+			}
+			fmt.Println("Merge these commits back by hand, or -exclude the ones master already has.")
+		}
+		return false
+	}
+
+	title := fmt.Sprintf("Merge %s back into %s", relBranch, repo.MasterBranch)
+	description := fmt.Sprintf("Cherry-picked from %s:\n\n- %s", relBranch, strings.Join(summary, "\n- "))
+	if len(skipped) > 0 {
+		description += fmt.Sprintf("\n\nLeft out:\n\n- %s", strings.Join(skipped, "\n- "))
+	}
+	if len(candidates) > 0 {
+		description += fmt.Sprintf("\n\nCheck these are not on %s already:\n\n- %s", repo.MasterBranch, strings.Join(candidates, "\n- "))
+	}
+	pullRequest, err := submitPullRequest(client, repo, topicBranch, repo.MasterBranch, title, description, withReleaseMessage(repo.PullRequestOptions["mergeback"], "", relBranch))
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return false
+	}
+	fmt.Printf("Opened PR %v from %s to %s.\n", pullRequest.PullRequestID, topicBranch, repo.MasterBranch)
+	postStatus(client, repo, pullRequest.PullRequestID, prStatus{
+		Action:    fmt.Sprintf("Merge %s back into %s", relBranch, repo.MasterBranch),
+		RelBranch: relBranch,
+		Commits:   summary,
+	})
+	return true
+}
+
+// mergeBackConflicts returns the files changed by commitIDs which were also
+// changed on master since the fork point, where the cherry-pick may have
+// run into conflicts.
+func mergeBackConflicts(client *http.Client, repo repoConfig, forkCommitID string, commitIDs []string) []string {
+	masterPaths := map[string]bool{}
+	for _, change := range getDiffs(client, repo, "commit", forkCommitID, "branch", repo.MasterBranch).Changes {
+		if !change.Item.IsFolder {
+			masterPaths[change.Item.Path] = true
+		}
+	}
+
+	conflicts := map[string]bool{}
+	for _, commitID := range commitIDs {
+		for _, change := range getCommit(client, repo, commitID).Changes {
+			if masterPaths[change.Item.Path] {
+				conflicts[change.Item.Path] = true
+			}
+		}
+	}
+
+	paths := []string{}
+	for p := range conflicts {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
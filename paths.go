@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// globPattern compiles a glob over repository paths. "*" and "?" stay
+// within one path segment, "**" crosses segments and "**/" also matches no
+// directory at all. Patterns without a leading "/" are rooted at the
+// repository.
+func globPattern(glob string) (*regexp.Regexp, error) {
+	if !strings.HasPrefix(glob, "/") {
+		glob = "/" + glob
+	}
+
+	expr := new(strings.Builder)
+	expr.WriteString("^")
+	literal := 0
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		if c != '*' && c != '?' {
+			continue
+		}
+		// quote the literal run as a whole, it may hold multi-byte runes
+		expr.WriteString(regexp.QuoteMeta(glob[literal:i]))
+		switch {
+		case c == '?':
+			expr.WriteString("[^/]")
+		case strings.HasPrefix(glob[i:], "**/"):
+			expr.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			expr.WriteString(".*")
+			i++
+		default:
+			expr.WriteString("[^/]*")
+		}
+		literal = i + 1
+	}
+	expr.WriteString(regexp.QuoteMeta(glob[literal:]))
+	expr.WriteString("$")
+	return regexp.Compile(expr.String())
+}
+
+func matchAnyGlob(globs []string, p string) (bool, error) {
+	for _, glob := range globs {
+		pattern, err := globPattern(glob)
+		if err != nil {
+			return false, err
+		}
+		if pattern.MatchString(p) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// syncPathAllowed tells if a file may change in the master version PR.
+// The version file always may, other files must match syncAllowPaths.
+// syncDenyPaths are checked first and hold for the version file too.
+func syncPathAllowed(repo repoConfig, p string) (bool, error) {
+	denied, err := matchAnyGlob(repo.SyncDenyPaths, p)
+	if err != nil || denied {
+		return false, err
+	}
+	if isVersionPath, err := matchAnyGlob([]string{repo.VersionPath}, p); err != nil || isVersionPath {
+		return isVersionPath, err
+	}
+	return matchAnyGlob(repo.SyncAllowPaths, p)
+}
+
+// releaseSyncChanges returns the changes relBranch made since its fork
+// point to the files syncPathAllowed lets through, as they are on
+// relBranch, to push to master with the version. The version file is left
+// out, only its version entries go to master.
+func releaseSyncChanges(client *http.Client, repo repoConfig, relBranch string) ([]change, error) {
+	if len(repo.SyncAllowPaths) == 0 {
+		return nil, nil
+	}
+
+	diffs := getDiffsBetweenBranches(client, repo, repo.MasterBranch, relBranch)
+	if !diffs.AllChangesIncluded {
+		return nil, fmt.Errorf("diff between %s and %s is too large to sync", repo.MasterBranch, relBranch)
+	}
+
+	changes := []change{}
+	for _, d := range diffs.Changes {
+		p := d.Item.Path
+		if d.Item.IsFolder {
+			continue
+		}
+		isVersionPath, err := matchAnyGlob([]string{repo.VersionPath}, p)
+		if err != nil {
+			return nil, err
+		}
+		allowed, err := syncPathAllowed(repo, p)
+		if err != nil {
+			return nil, err
+		}
+		if isVersionPath || !allowed {
+			continue
+		}
+
+		relContent, onRelease, err := getFileContent(client, repo, p, "branch", relBranch)
+		if err != nil {
+			return nil, err
+		}
+		masterContent, onMaster, err := getFileContent(client, repo, p, "branch", repo.MasterBranch)
+		if err != nil {
+			return nil, err
+		}
+
+		c := change{Item: item{Path: p}}
+		switch {
+		case !onRelease && !onMaster, onRelease && onMaster && bytes.Equal(relContent, masterContent):
+			continue
+		case !onRelease:
+			c.ChangeType = "delete"
+		case onMaster:
+			c.ChangeType = "edit"
+		default:
+			c.ChangeType = "add"
+		}
+		if onRelease {
+			c.NewContent = &newContent{
+				ContentType: "base64encoded",
+				Content:     base64.StdEncoding.EncodeToString(relContent),
+			}
+		}
+		fmt.Printf("Sync %s from %s (%s)\n", p, relBranch, c.ChangeType)
+		changes = append(changes, c)
+	}
+	return changes, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import "testing"
+
+func TestGlobPattern(t *testing.T) {
+	tests := []struct {
+		glob  string
+		path  string
+		match bool
+	}{
+		{"version.xml", "/version.xml", true},
+		{"/version.xml", "/version.xml", true},
+		{"version.xml", "/src/version.xml", false},
+		{"version.xml", "/version.xml.bak", false},
+		{"a.b", "/axb", false},
+		{"src/*.xml", "/src/version.xml", true},
+		{"src/*.xml", "/src/sub/version.xml", false},
+		{"src/v?.txt", "/src/v1.txt", true},
+		{"src/v?.txt", "/src/v/.txt", false},
+		{"src/**", "/src/sub/dir/a.cs", true},
+		{"src/**/version.xml", "/src/a/b/version.xml", true},
+		{"src/**/version.xml", "/other/a/version.xml", false},
+		{"**/version.xml", "/a/version.xml", true},
+		{"**/version.xml", "/version.xml", true},
+		{"src/**/version.xml", "/src/version.xml", true},
+		{"src/**/version.xml", "/srcversion.xml", false},
+		{"docs/é*.md", "/docs/été.md", true},
+		{"docs/?té.md", "/docs/été.md", true},
+		{"docs/é.md", "/docs/e.md", false},
+		{"**.props", "/build/Directory.Build.props", true},
+	}
+
+	for _, tt := range tests {
+		pattern, err := globPattern(tt.glob)
+		if err != nil {
+			t.Fatalf("globPattern(%q): %v", tt.glob, err)
+		}
+		if got := pattern.MatchString(tt.path); got != tt.match {
+			t.Errorf("globPattern(%q) matches %q: %v, want %v", tt.glob, tt.path, got, tt.match)
+		}
+	}
+}
+
+func TestMatchAnyGlob(t *testing.T) {
+	tests := []struct {
+		globs []string
+		path  string
+		match bool
+	}{
+		{nil, "/version.xml", false},
+		{[]string{"version.xml"}, "/version.xml", true},
+		{[]string{"*.props", "src/**"}, "/src/a.cs", true},
+		{[]string{"*.props", "src/**"}, "/test/a.cs", false},
+	}
+
+	for _, tt := range tests {
+		got, err := matchAnyGlob(tt.globs, tt.path)
+		if err != nil || got != tt.match {
+			t.Errorf("matchAnyGlob(%q, %q) = %v, %v, want %v", tt.globs, tt.path, got, err, tt.match)
+		}
+	}
+}
+
+func TestSyncPathAllowed(t *testing.T) {
+	tests := []struct {
+		name    string
+		repo    repoConfig
+		path    string
+		allowed bool
+	}{
+		{
+			name:    "version file by default",
+			repo:    repoConfig{VersionPath: "/version.xml"},
+			path:    "/version.xml",
+			allowed: true,
+		},
+		{
+			name:    "other file by default",
+			repo:    repoConfig{VersionPath: "/version.xml"},
+			path:    "/src/a.cs",
+			allowed: false,
+		},
+		{
+			name:    "allowed",
+			repo:    repoConfig{VersionPath: "/version.xml", SyncAllowPaths: []string{"src/**"}},
+			path:    "/src/a.cs",
+			allowed: true,
+		},
+		{
+			name:    "version path without leading slash",
+			repo:    repoConfig{VersionPath: "build/version.xml", SyncAllowPaths: []string{"CHANGELOG.md"}},
+			path:    "/build/version.xml",
+			allowed: true,
+		},
+		{
+			name:    "allow keeps the version file",
+			repo:    repoConfig{VersionPath: "/version.xml", SyncAllowPaths: []string{"CHANGELOG.md"}},
+			path:    "/version.xml",
+			allowed: true,
+		},
+		{
+			name:    "deny before allow",
+			repo:    repoConfig{VersionPath: "/version.xml", SyncAllowPaths: []string{"src/**"}, SyncDenyPaths: []string{"src/secret/**"}},
+			path:    "/src/secret/key.cs",
+			allowed: false,
+		},
+		{
+			name:    "deny the version file",
+			repo:    repoConfig{VersionPath: "/version.xml", SyncDenyPaths: []string{"*.xml"}},
+			path:    "/version.xml",
+			allowed: false,
+		},
+	}
+
+	for _, tt := range tests {
+		got, err := syncPathAllowed(tt.repo, tt.path)
+		if err != nil || got != tt.allowed {
+			t.Errorf("%s: syncPathAllowed(%q) = %v, %v, want %v", tt.name, tt.path, got, err, tt.allowed)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// finishPullRequest completes a PR the tool opened. Unless
+// respectPolicies is set the branch policies are bypassed, otherwise the
+// tool approves as itself and completes once every blocking policy passed.
+func finishPullRequest(client *http.Client, repo repoConfig, pullRequest gitPullRequest, commitID string, options pullRequestOptions) bool {
+	completion, err := completionOptionsFor(options, pullRequest, !repo.RespectPolicies)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return false
+	}
+
+	if !repo.RespectPolicies {
+		if err := completePullRequest(client, repo, pullRequest.PullRequestID, commitID, completion); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return false
+		}
+		return true
+	}
+
+	if pullRequest.Repository.Project.ID == "" || pullRequest.CreatedBy.ID == "" {
+		pullRequest = getPullRequest(client, repo, pullRequest.PullRequestID)
+	}
+
+	// the policies decide if the vote of the author counts
+	if err := votePullRequest(client, repo, pullRequest.PullRequestID, pullRequest.CreatedBy.ID, 10); err != nil {
+		fmt.Printf("Cannot approve PR %v: %v\n", pullRequest.PullRequestID, err)
+	}
+
+	timeout := time.Duration(repo.PolicyTimeoutMinutes) * time.Minute
+	if timeout <= 0 {
+		timeout = time.Hour
+	}
+
+	blocking, err := waitForPolicies(client, repo, pullRequest, timeout)
+	if err != nil {
+		fmt.Printf("Error policies of PR %v: %v\n", pullRequest.PullRequestID, err)
+		return false
+	}
+	if len(blocking) > 0 {
+		fmt.Printf("PR %v not completed, blocked by policies:\n", pullRequest.PullRequestID)
+		for _, e := range blocking {
+			fmt.Printf("  %s (configuration %v): %s\n", e.Configuration.Type.DisplayName, e.Configuration.ID, e.Status)
+		}
+		return false
+	}
+
+	if err := completePullRequest(client, repo, pullRequest.PullRequestID, commitID, completion); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return false
+	}
+	return true
+}
+
+// waitForPolicies polls the policy evaluations of a PR until every
+// blocking policy is approved, one is rejected or timeout passes, and
+// returns the policies still blocking. The evaluations are queued after the
+// PR is created, so none at all only means the branch has no policies once
+// the merge status of the PR settled.
+func waitForPolicies(client *http.Client, repo repoConfig, pullRequest gitPullRequest, timeout time.Duration) ([]policyEvaluation, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		evaluations, err := getPolicyEvaluations(client, pullRequest)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(evaluations.Value) == 0 {
+			mergeStatus := getPullRequest(client, repo, pullRequest.PullRequestID).MergeStatus
+			if mergeStatus != "notSet" && mergeStatus != "queued" {
+				return nil, nil
+			}
+			if !time.Now().Before(deadline) {
+				return nil, fmt.Errorf("no policy evaluations and merge status %s after %v", mergeStatus, timeout)
+			}
+			fmt.Printf("PR %v waits for its policy evaluations...\n", pullRequest.PullRequestID)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+
+		blocking := []policyEvaluation{}
+		rejected := false
+		for _, e := range evaluations.Value {
+			if !e.Configuration.IsEnabled || !e.Configuration.IsBlocking {
+				continue
+			}
+			switch e.Status {
+			case "approved", "notApplicable":
+				continue
+			case "rejected", "broken":
+				rejected = true
+			}
+			blocking = append(blocking, e)
+		}
+
+		if len(blocking) == 0 || rejected || !time.Now().Before(deadline) {
+			return blocking, nil
+		}
+
+		fmt.Printf("PR %v waits for %v policies...\n", pullRequest.PullRequestID, len(blocking))
+		time.Sleep(30 * time.Second)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// pullRequestOptions are applied to the PRs opened for one purpose.
+type pullRequestOptions struct {
+	// Reviewers and RequiredReviewers are user or group names, resolved
+	// through the identity search.
+	Reviewers         []string `json:"reviewers"`
+	RequiredReviewers []string `json:"requiredReviewers"`
+	WorkItems         []int    `json:"workItems"`
+	Labels            []string `json:"labels"`
+	Draft             bool     `json:"draft"`
+	// AutoComplete completes the PR once its policies pass.
+	AutoComplete bool `json:"autoComplete"`
+	// MergeStrategy is noFastForward, squash (the default), rebase or
+	// rebaseMerge.
+	MergeStrategy string `json:"mergeStrategy"`
+	// MergeMessage is the merge commit message template, it may use
+	// {title}, {id}, {version} and {branch}. Defaults to the title.
+	MergeMessage        string `json:"mergeMessage"`
+	DeleteSourceBranch  bool   `json:"deleteSourceBranch"`
+	TransitionWorkItems bool   `json:"transitionWorkItems"`
+}
+
+var mergeStrategies = map[string]bool{
+	"noFastForward": true,
+	"squash":        true,
+	"rebase":        true,
+	"rebaseMerge":   true,
+}
+
+// withReleaseMessage fills the release version and branch into the merge
+// message template of options.
+func withReleaseMessage(options pullRequestOptions, relVersion string, relBranch string) pullRequestOptions {
+	if options.MergeMessage != "" {
+		r := strings.NewReplacer("{version}", relVersion, "{branch}", relBranch)
+		options.MergeMessage = r.Replace(options.MergeMessage)
+	}
+	return options
+}
+
+// completionOptionsFor returns how pullRequest is completed with options.
+func completionOptionsFor(options pullRequestOptions, pullRequest gitPullRequest, bypassPolicy bool) (completionOptions, error) {
+	strategy := options.MergeStrategy
+	if strategy == "" {
+		strategy = "squash"
+	}
+	if !mergeStrategies[strategy] {
+		return completionOptions{}, fmt.Errorf("unknown merge strategy %q", strategy)
+	}
+
+	message := pullRequest.Title
+	if options.MergeMessage != "" {
+		r := strings.NewReplacer(
+			"{title}", pullRequest.Title,
+			"{id}", strconv.Itoa(pullRequest.PullRequestID),
+			"{version}", "",
+			"{branch}", "")
+		message = r.Replace(options.MergeMessage)
+	}
+
+	return completionOptions{
+		MergeCommitMessage:  message,
+		SquashMerge:         strconv.FormatBool(strategy == "squash"),
+		MergeStrategy:       strategy,
+		DeleteSourceBranch:  strconv.FormatBool(options.DeleteSourceBranch),
+		TransitionWorkItems: strconv.FormatBool(options.TransitionWorkItems),
+		BypassPolicy:        strconv.FormatBool(bypassPolicy),
+	}, nil
+}
+
+// resolveReviewers looks up the reviewer names of options. A name must
+// match exactly one user or group.
+func resolveReviewers(client *http.Client, options pullRequestOptions) ([]reviewer, error) {
+	reviewers := []reviewer{}
+	names := map[string]bool{}
+	for _, name := range options.RequiredReviewers {
+		names[name] = true
+	}
+	for _, name := range append(append([]string{}, options.RequiredReviewers...), options.Reviewers...) {
+		identities, err := getIdentities(client, name)
+		if err != nil {
+			return nil, err
+		}
+		if identities.Count != 1 {
+			found := []string{}
+			for _, i := range identities.Value {
+				found = append(found, i.ProviderDisplayName)
+			}
+			return nil, fmt.Errorf("reviewer %q matches %v identities: %s", name, identities.Count, strings.Join(found, ", "))
+		}
+
+		id := identities.Value[0].ID
+		duplicate := false
+		for _, r := range reviewers {
+			duplicate = duplicate || r.ID == id
+		}
+		if !duplicate {
+			reviewers = append(reviewers, reviewer{ID: id, IsRequired: names[name]})
+		}
+	}
+	return reviewers, nil
+}
+
+// toolLabel marks the PRs opened by this tool, next to the marker in their
+// description.
+const toolLabel = "vsts-branch"
+
+const versionMarkerPrefix = "<!-- vsts-branch version "
+
+// versionPullRequestMarker is hidden in the description of the master
+// version PR of relBranch.
+func versionPullRequestMarker(relBranch string) string {
+	return fmt.Sprintf("%s%s -->", versionMarkerPrefix, relBranch)
+}
+
+// isVersionPullRequest tells if pr is a master version PR of this tool,
+// by the marker or, if the description was edited, by the label. The
+// source branch name alone does not tell, other PRs may come from a
+// branch under version/ as well.
+func isVersionPullRequest(client *http.Client, repo repoConfig, pr gitPullRequest) bool {
+	if strings.Contains(pr.Description, versionMarkerPrefix) {
+		return true
+	}
+	if pr.Title != versionResetComment {
+		return false
+	}
+	for _, label := range getPullRequestLabels(client, repo, pr.PullRequestID).Value {
+		if label.Name == toolLabel && label.Active {
+			return true
+		}
+	}
+	return false
+}
+
+// reconcileVersionPullRequests finds the active master version PR of
+// relBranch, opened from its topic branch or carrying its marker. Of
+// several the newest is kept, the others and those left over from earlier
+// trains are abandoned with a comment. Completed and abandoned PRs are not
+// looked at.
+func reconcileVersionPullRequests(client *http.Client, repo repoConfig, relBranch string) (gitPullRequest, bool) {
+	current := []gitPullRequest{}
+	stale := []gitPullRequest{}
+	topicRefName := fmt.Sprintf("%s/%s", "refs/heads", versionTopicBranch(relBranch))
+	for _, pr := range searchPullRequests(client, repo, "Active", repo.MasterBranch, "", 100).Value {
+		// only the tool pushes the topic branch, so its PR is the version
+		// PR even with the marker and the label removed
+		switch {
+		case pr.SourceRefName == topicRefName, strings.Contains(pr.Description, versionPullRequestMarker(relBranch)):
+			current = append(current, pr)
+		case isVersionPullRequest(client, repo, pr):
+			stale = append(stale, pr)
+		}
+	}
+
+	sort.Slice(current, func(i, j int) bool { return current[i].CreationDate.After(current[j].CreationDate) })
+
+	if len(current) > 1 {
+		for _, pr := range current[1:] {
+			content := fmt.Sprintf("Abandoned by vsts-branch, duplicate of !%v for %s.", current[0].PullRequestID, relBranch)
+			postPullRequestThread(client, repo, pr.PullRequestID, content, "closed")
+			abandonPullRequest(client, repo, pr.PullRequestID)
+		}
+	}
+	for _, pr := range stale {
+		content := fmt.Sprintf("Abandoned by vsts-branch, superseded by the version PR for %s.", relBranch)
+		postPullRequestThread(client, repo, pr.PullRequestID, content, "closed")
+		abandonPullRequest(client, repo, pr.PullRequestID)
+	}
+
+	if len(current) == 0 {
+		return gitPullRequest{}, false
+	}
+	fmt.Printf("Found version PR %v for %s\n", current[0].PullRequestID, relBranch)
+	return current[0], true
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// versionResetMarker is the tag resetBuildVersion leaves on the version
+// reset commit of relBranch.
+func versionResetMarker(relBranch string) string {
+	return fmt.Sprintf("%s/%s", "refs/tags/release-reset", relBranch)
+}
+
+// versionResetDone tells whether the version of relBranch, currently at
+// build, was already reset. It looks for the reset marker first and falls
+// back to comparing with the version at the fork point, both take a fixed
+// number of requests.
+func versionResetDone(client *http.Client, repo repoConfig, scheme versionScheme, relBranch string, build string) (bool, error) {
+	marker := versionResetMarker(relBranch)
+	if m, found := findRef(client, repo, marker); found {
+		fmt.Printf("Found version reset marker %s at %s\n", marker, m.ObjectID)
+		return true, nil
+	}
+
+	diffs := getDiffsBetweenBranches(client, repo, repo.MasterBranch, relBranch)
+	if diffs.CommonCommit == "" {
+		return false, fmt.Errorf("no fork point of %s and %s", repo.MasterBranch, relBranch)
+	}
+
+	forkFile, err := getCommitVersionFile(client, repo, diffs.CommonCommit)
+	if err != nil {
+		return false, err
+	}
+	forkVersion, err := buildVersion(repo, forkFile)
+	if err != nil {
+		return false, err
+	}
+	forkBuild, err := scheme.Build(forkVersion.Value)
+	if err != nil {
+		return false, err
+	}
+
+	if forkBuild != build {
+		fmt.Printf("Found version before fork: Commit %s: %s\n", diffs.CommonCommit, forkVersion.Value)
+		return true, nil
+	}
+	return false, nil
+}
+
+// blobCache holds version file contents by blob id for the whole run,
+// so the same content is downloaded once even by concurrent scans.
+type blobCache struct {
+	mu    sync.Mutex
+	blobs map[string]*cachedBlob
+}
+
+type cachedBlob struct {
+	done    chan struct{}
+	content []byte
+	err     error
+}
+
+var versionBlobs = blobCache{blobs: map[string]*cachedBlob{}}
+
+func (c *blobCache) get(ctx context.Context, client *http.Client, repo repoConfig, objectID string) ([]byte, error) {
+	c.mu.Lock()
+	b, ok := c.blobs[objectID]
+	if !ok {
+		b = &cachedBlob{done: make(chan struct{})}
+		c.blobs[objectID] = b
+	}
+	c.mu.Unlock()
+
+	if !ok {
+		b.content, b.err = getBlob(ctx, client, repo, objectID)
+		close(b.done)
+		if b.err != nil {
+			// let the next caller try again
+			c.mu.Lock()
+			delete(c.blobs, objectID)
+			c.mu.Unlock()
+		}
+	}
+
+	select {
+	case <-b.done:
+		return b.content, b.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func commitBuildVersion(ctx context.Context, client *http.Client, repo repoConfig, commitID string) (version, error) {
+	objectID, err := getItemObjectID(ctx, client, repo, "commit", commitID)
+	if err != nil {
+		return version{}, err
+	}
+
+	content, err := versionBlobs.get(ctx, client, repo, objectID)
+	if err != nil {
+		return version{}, err
+	}
+
+	versionFile, err := parseVersionFile(versionFormat(repo), content)
+	if err != nil {
+		return version{}, err
+	}
+	return buildVersion(repo, versionFile)
+}
+
+// scanVersionHistory looks for a different build in the version file
+// history of relBranch since the last release day. It is kept for
+// branches cut before reset markers existed. Commits are checked by
+// historyScanWorkers goroutines, which stop at the first different build.
+func scanVersionHistory(client *http.Client, repo repoConfig, scheme versionScheme, relBranch string, build string, branchDay int) bool {
+	n := time.Now()
+	daysLookBack := (branchDay-7-int(n.Weekday()))%7 - 2
+
+	commits := getCommits(client, repo, relBranch, n.AddDate(0, 0, daysLookBack), n)
+	fmt.Println(commits.Count)
+
+	workers := repo.HistoryScanWorkers
+	if workers < 1 {
+		workers = 4
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	jobs := make(chan string)
+	found := make(chan string, 1)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for commitID := range jobs {
+				commitVersion, err := commitBuildVersion(ctx, client, repo, commitID)
+				if ctx.Err() != nil {
+					continue
+				}
+				if err != nil {
+					fmt.Printf("Skip commit %s: %v\n", commitID, err)
+					continue
+				}
+
+				commitBuild, err := scheme.Build(commitVersion.Value)
+				if err != nil {
+					fmt.Printf("Skip commit %s: %v\n", commitID, err)
+					continue
+				}
+
+				if commitBuild != build {
+					select {
+					case found <- fmt.Sprintf("Commit %s: %s", commitID, commitVersion.Value):
+					default:
+					}
+					cancel()
+				}
+			}
+		}()
+	}
+
+feed:
+	for _, commit := range commits.Value {
+		select {
+		case jobs <- commit.CommitID:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	select {
+	case f := <-found:
+		fmt.Printf("Found version before fork: %s\n", f)
+		return true
+	default:
+		fmt.Printf("No version change found in %v days.\n", daysLookBack)
+		return false
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"time"
+)
+
+// rollbackReleaseTrain rolls back the release cut for releaseDate in every
+// repository, each with its own release branch name.
+func rollbackReleaseTrain(releaseDate time.Time, revertMaster bool) {
+	failed := 0
+	for _, repo := range secret.repositories() {
+		relBranch := releaseBranchName(repo, releaseDate)
+		if !rollbackReleaseRecovered(repo, relBranch, revertMaster) {
+			fmt.Printf("%s: rollback of %s failed.\n", repo.Repo, relBranch)
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		fmt.Printf("Rollback of the release of %s failed in %v repositories.\n", releaseDate.Format("2006-01-02"), failed)
+		os.Exit(1)
+	}
+}
+
+// rollbackReleaseRecovered rolls back like rollbackRelease, recording a
+// panic as a failed rollback instead of ending the rollback of the train.
+func rollbackReleaseRecovered(repo repoConfig, relBranch string, revertMaster bool) (succeeded bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Printf("%s: rollback panicked: %v\n%s\n", repo.Repo, r, debug.Stack())
+			succeeded = false
+		}
+	}()
+	return rollbackRelease(repo, relBranch, revertMaster)
+}
+
+// rollbackRelease reverses what cutRelease did to relBranch, using the
+// branch history to find the fork point and the version before the cut.
+func rollbackRelease(repo repoConfig, relBranch string, revertMaster bool) bool {
+	client := &http.Client{}
+
+	relRef := ref{}
+	relBranches := getRelBranches(client, repo, relBranch)
+	for _, b := range relBranches.Value {
+		if b.Name == fmt.Sprintf("%s/%s", "refs/heads", relBranch) {
+			relRef = b
+			break
+		}
+	}
+
+	if relRef.ObjectID == "" {
+		fmt.Printf("%s: release branch %s not found, nothing to roll back.\n", repo.Repo, relBranch)
+		return true
+	}
+
+	// collect versions before the branch goes away
+	diffs := getDiffsBetweenBranches(client, repo, repo.MasterBranch, relBranch)
+	fmt.Printf("%s: %s forked from %s at %s\n", repo.Repo, relBranch, repo.MasterBranch, diffs.CommonCommit)
+
+	var forkFile, relFile versionFile
+	if revertMaster {
+		var err error
+		forkFile, err = getCommitVersionFile(client, repo, diffs.CommonCommit)
+		if err != nil {
+			fmt.Printf("Error version file at fork point: %v\n", err)
+			return false
+		}
+		relFile, err = getCommitVersionFile(client, repo, relRef.ObjectID)
+		if err != nil {
+			fmt.Printf("Error version file in %s: %v\n", relBranch, err)
+			return false
+		}
+	}
+
+	succeeded := true
+
+	// abandon version PR and its topic branch
+	topicBranch := versionTopicBranch(relBranch)
+	pullRequests := getPullRequests(client, repo, repo.MasterBranch, topicBranch)
+	for _, pr := range pullRequests.Value {
+		if pr.Title != versionResetComment {
+			fmt.Printf("Skip PR %v, not created by release cut: %s\n", pr.PullRequestID, pr.Title)
+			continue
+		}
+		abandonPullRequest(client, repo, pr.PullRequestID)
+	}
+	for _, b := range getRelBranches(client, repo, topicBranch).Value {
+		if b.Name == fmt.Sprintf("%s/%s", "refs/heads", topicBranch) && !deleteBranch(client, repo, topicBranch, b.ObjectID) {
+			fmt.Printf("Failed to delete %s\n", topicBranch)
+			succeeded = false
+		}
+	}
+
+	// cancel queued builds
+	defs := getBuildDefinitions(client, repo, relBranch)
+	for _, def := range defs.Value {
+		builds := getBuilds(client, def.ID)
+		for _, b := range builds.Value {
+			if b.SourceBranch != fmt.Sprintf("%s/%s", "refs/heads", relBranch) {
+				continue
+			}
+			if b.Status == "notStarted" || b.Status == "inProgress" {
+				cancelBuild(client, b.ID)
+			}
+		}
+	}
+
+	// delete branch, only if nobody pushed to it since we looked
+	if !deleteBranch(client, repo, relBranch, relRef.ObjectID) {
+		fmt.Printf("Failed to delete %s, it may have moved from %s\n", relBranch, relRef.ObjectID)
+		succeeded = false
+	}
+
+	// drop the version reset marker, so a new cut resets again
+	marker := versionResetMarker(relBranch)
+	m, found := findRef(client, repo, marker)
+	resetCommitID := m.ObjectID
+	if found && !updateRef(client, repo, marker, m.ObjectID, zeroObjectID) {
+		fmt.Printf("Failed to delete %s\n", marker)
+		succeeded = false
+	}
+
+	// and the superseded marker, so a new cut deals with the PRs again
+	superseded := supersededMarker(relBranch)
+	if m, found := findRef(client, repo, superseded); found && !updateRef(client, repo, superseded, m.ObjectID, zeroObjectID) {
+		fmt.Printf("Failed to delete %s\n", superseded)
+		succeeded = false
+	}
+
+	// and the release tags, a new cut may fork from another commit
+	if repo.CreateReleaseTags {
+		relVersion := ""
+		if resetCommitID != "" {
+			if v, err := commitReleaseVersion(client, repo, resetCommitID); err == nil {
+				relVersion = v
+			}
+		}
+		if !deleteReleaseTags(client, repo, relBranch, diffs.CommonCommit, resetCommitID, relVersion) {
+			fmt.Printf("Failed to delete the release tags of %s\n", relBranch)
+			succeeded = false
+		}
+	}
+
+	if revertMaster && !revertMasterVersion(client, repo, relBranch, forkFile, relFile) {
+		succeeded = false
+	}
+
+	return succeeded
+}
+
+// revertMasterVersion puts the fork point versions back on master if the
+// release version was merged there.
+func revertMasterVersion(client *http.Client, repo repoConfig, relBranch string, forkFile versionFile, relFile versionFile) bool {
+	forkVersion, err := buildVersion(repo, forkFile)
+	if err != nil {
+		fmt.Printf("Error version file at fork point: %v\n", err)
+		return false
+	}
+	relVersion, err := buildVersion(repo, relFile)
+	if err != nil {
+		fmt.Printf("Error version file in %s: %v\n", relBranch, err)
+		return false
+	}
+
+	masterBranch := getMasterBranch(client, repo)
+	masterFile, err := getCommitVersionFile(client, repo, masterBranch.ObjectID)
+	if err != nil {
+		fmt.Printf("Error version file in %s: %v\n", repo.MasterBranch, err)
+		return false
+	}
+	masterVersion, err := buildVersion(repo, masterFile)
+	if err != nil {
+		fmt.Printf("Error version file in %s: %v\n", repo.MasterBranch, err)
+		return false
+	}
+
+	// the scheme of the cut, calver counts the next train from its date
+	releaseDate, err := releaseBranchDate(repo, relBranch)
+	if err != nil {
+		fmt.Printf("Error release date: %v\n", err)
+		return false
+	}
+	scheme, err := newVersionScheme(repo, releaseDate)
+	if err != nil {
+		fmt.Printf("Error version scheme: %v\n", err)
+		return false
+	}
+
+	// master carries the release version, or with calver the next train's
+	masterTarget, err := scheme.MasterVersion(relVersion.Value)
+	if err != nil {
+		fmt.Printf("Error version file in %s: %v\n", relBranch, err)
+		return false
+	}
+
+	builds := []string{}
+	for _, v := range []version{masterVersion, {Name: relVersion.Name, Value: masterTarget}, forkVersion} {
+		build, err := scheme.Build(v.Value)
+		if err != nil {
+			fmt.Printf("Error version file: %v\n", err)
+			return false
+		}
+		builds = append(builds, build)
+	}
+	masterBuild, targetBuild, forkBuild := builds[0], builds[1], builds[2]
+
+	if masterBuild == forkBuild {
+		fmt.Printf("%s branch is already version: %s\n", repo.MasterBranch, masterVersion.Value)
+		return true
+	}
+
+	if masterBuild != targetBuild {
+		fmt.Printf("%s branch is at %s, not the version %s set by the release cut, skip revert.\n", repo.MasterBranch, masterVersion.Value, masterTarget)
+		return false
+	}
+
+	forkResets, err := resetVersions(repo, forkFile)
+	if err != nil {
+		fmt.Printf("Error version file at fork point: %v\n", err)
+		return false
+	}
+	for _, v := range forkResets {
+		fmt.Printf("Revert %s version %s to: %s\n", repo.MasterBranch, v.Name, v.Value)
+		if err := masterFile.SetVersion(v.Name, v.Value); err != nil {
+			fmt.Println(err)
+			return false
+		}
+	}
+	if pushVersionFile(client, repo, masterFile, repo.MasterBranch, masterBranch.ObjectID, fmt.Sprintf("Revert version for release %s", relBranch)) == "" {
+		fmt.Printf("Failed to push version to %s\n", repo.MasterBranch)
+		return false
+	}
+	return true
+}
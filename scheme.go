@@ -0,0 +1,634 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// versionScheme knows how a version string is laid out, which part of it
+// identifies the release train (the build) and what a release cut does.
+type versionScheme interface {
+	// Build returns the release train part of v.
+	Build(v string) (string, error)
+	// NextBuild returns the release train after build.
+	NextBuild(build string) (string, error)
+	// Release returns v cut for release train build.
+	Release(v string, build string) (string, error)
+	// IsRelease reports whether v already looks like a fresh release cut.
+	IsRelease(v string) (bool, error)
+	// Compare orders two versions, like strings.Compare.
+	Compare(a string, b string) (int, error)
+	// MasterVersion returns the version master should carry after the
+	// release branch is at relVersion.
+	MasterVersion(relVersion string) (string, error)
+	// NextRevision returns v with its revision bumped for a hotfix.
+	NextRevision(v string) (string, error)
+}
+
+// newVersionScheme returns the scheme of repo for the release train on
+// releaseDate, the next train follows a week later.
+func newVersionScheme(repo repoConfig, releaseDate time.Time) (versionScheme, error) {
+	switch repo.VersionScheme {
+	case "", "numeric":
+		return newNumericScheme(repo.BumpComponent, repo.ResetComponents)
+	case "semver":
+		return newSemVerScheme(repo.BumpComponent, repo.ResetComponents)
+	case "calver":
+		return newCalVerScheme(repo.CalVerFormat, releaseDate, releaseDate.AddDate(0, 0, 7))
+	default:
+		return nil, fmt.Errorf("unknown version scheme %q", repo.VersionScheme)
+	}
+}
+
+func compareInt(a int, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// numericScheme is a dotted numeric version such as 1.2.3.4. Components
+// are counted from the start, or from the end when negative.
+type numericScheme struct {
+	bump int
+	// resets are the components set to 0 on a cut, nil for all after bump
+	resets []int
+}
+
+func newNumericScheme(bump string, resets []string) (numericScheme, error) {
+	s := numericScheme{bump: -2}
+	if bump != "" {
+		i, err := strconv.Atoi(bump)
+		if err != nil {
+			return s, fmt.Errorf("bumpComponent %q is not an index", bump)
+		}
+		s.bump = i
+	}
+	for _, reset := range resets {
+		i, err := strconv.Atoi(reset)
+		if err != nil {
+			return s, fmt.Errorf("resetComponents %q is not an index", reset)
+		}
+		s.resets = append(s.resets, i)
+	}
+	return s, nil
+}
+
+func parseNumeric(v string) ([]int, error) {
+	parts := strings.Split(v, ".")
+	numbers := make([]int, len(parts))
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("version %q: component %q is not a number", v, part)
+		}
+		numbers[i] = n
+	}
+	return numbers, nil
+}
+
+func formatNumeric(numbers []int) string {
+	parts := make([]string, len(numbers))
+	for i, n := range numbers {
+		parts[i] = strconv.Itoa(n)
+	}
+	return strings.Join(parts, ".")
+}
+
+func (s numericScheme) index(v string, numbers []int, component int) (int, error) {
+	i := component
+	if i < 0 {
+		i += len(numbers)
+	}
+	if i < 0 || i >= len(numbers) {
+		return 0, fmt.Errorf("version %q has no component %v", v, component)
+	}
+	return i, nil
+}
+
+func (s numericScheme) resetIndexes(v string, numbers []int) ([]int, error) {
+	bump, err := s.index(v, numbers, s.bump)
+	if err != nil {
+		return nil, err
+	}
+	if s.resets == nil {
+		indexes := []int{}
+		for i := bump + 1; i < len(numbers); i++ {
+			indexes = append(indexes, i)
+		}
+		return indexes, nil
+	}
+
+	indexes := []int{}
+	for _, reset := range s.resets {
+		i, err := s.index(v, numbers, reset)
+		if err != nil {
+			return nil, err
+		}
+		indexes = append(indexes, i)
+	}
+	return indexes, nil
+}
+
+func (s numericScheme) Build(v string) (string, error) {
+	numbers, err := parseNumeric(v)
+	if err != nil {
+		return "", err
+	}
+	i, err := s.index(v, numbers, s.bump)
+	if err != nil {
+		return "", err
+	}
+	return strconv.Itoa(numbers[i]), nil
+}
+
+func (s numericScheme) NextBuild(build string) (string, error) {
+	n, err := strconv.Atoi(build)
+	if err != nil {
+		return "", fmt.Errorf("build %q is not a number", build)
+	}
+	return strconv.Itoa(n + 1), nil
+}
+
+func (s numericScheme) Release(v string, build string) (string, error) {
+	numbers, err := parseNumeric(v)
+	if err != nil {
+		return "", err
+	}
+	bump, err := s.index(v, numbers, s.bump)
+	if err != nil {
+		return "", err
+	}
+	resets, err := s.resetIndexes(v, numbers)
+	if err != nil {
+		return "", err
+	}
+	n, err := strconv.Atoi(build)
+	if err != nil {
+		return "", fmt.Errorf("build %q is not a number", build)
+	}
+
+	numbers[bump] = n
+	for _, i := range resets {
+		numbers[i] = 0
+	}
+	return formatNumeric(numbers), nil
+}
+
+func (s numericScheme) IsRelease(v string) (bool, error) {
+	numbers, err := parseNumeric(v)
+	if err != nil {
+		return false, err
+	}
+	resets, err := s.resetIndexes(v, numbers)
+	if err != nil {
+		return false, err
+	}
+	for _, i := range resets {
+		if numbers[i] != 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (s numericScheme) Compare(a string, b string) (int, error) {
+	x, err := parseNumeric(a)
+	if err != nil {
+		return 0, err
+	}
+	y, err := parseNumeric(b)
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i < len(x) && i < len(y); i++ {
+		if c := compareInt(x[i], y[i]); c != 0 {
+			return c, nil
+		}
+	}
+	return compareInt(len(x), len(y)), nil
+}
+
+func (s numericScheme) MasterVersion(relVersion string) (string, error) {
+	_, err := parseNumeric(relVersion)
+	return relVersion, err
+}
+
+// NextRevision bumps the last component.
+func (s numericScheme) NextRevision(v string) (string, error) {
+	numbers, err := parseNumeric(v)
+	if err != nil {
+		return "", err
+	}
+	numbers[len(numbers)-1]++
+	return formatNumeric(numbers), nil
+}
+
+var semVerPattern = regexp.MustCompile(`^(0|[1-9]\d*)\.(0|[1-9]\d*)\.(0|[1-9]\d*)(?:-((?:0|[1-9]\d*|\d*[a-zA-Z-][0-9a-zA-Z-]*)(?:\.(?:0|[1-9]\d*|\d*[a-zA-Z-][0-9a-zA-Z-]*))*))?(?:\+([0-9a-zA-Z-]+(?:\.[0-9a-zA-Z-]+)*))?$`)
+
+var semVerComponents = []string{"major", "minor", "patch", "prerelease", "build"}
+
+type semVer struct {
+	numbers    [3]int
+	preRelease string
+	metadata   string
+}
+
+func parseSemVer(v string) (semVer, error) {
+	m := semVerPattern.FindStringSubmatch(v)
+	if m == nil {
+		return semVer{}, fmt.Errorf("version %q is not a SemVer 2.0 version", v)
+	}
+
+	s := semVer{preRelease: m[4], metadata: m[5]}
+	for i := range s.numbers {
+		n, err := strconv.Atoi(m[i+1])
+		if err != nil {
+			return semVer{}, fmt.Errorf("version %q: %v", v, err)
+		}
+		s.numbers[i] = n
+	}
+	return s, nil
+}
+
+func (v semVer) String() string {
+	s := fmt.Sprintf("%v.%v.%v", v.numbers[0], v.numbers[1], v.numbers[2])
+	if v.preRelease != "" {
+		s += "-" + v.preRelease
+	}
+	if v.metadata != "" {
+		s += "+" + v.metadata
+	}
+	return s
+}
+
+// semVerScheme bumps major, minor or patch on a cut. By default the lower
+// numbers are set to 0 and pre-release and build metadata are dropped.
+type semVerScheme struct {
+	bump   int
+	resets []string
+}
+
+func newSemVerScheme(bump string, resets []string) (semVerScheme, error) {
+	s := semVerScheme{bump: 1}
+	if bump != "" {
+		s.bump = -1
+		for i, name := range semVerComponents[:3] {
+			if name == bump {
+				s.bump = i
+			}
+		}
+		if s.bump < 0 {
+			return s, fmt.Errorf("bumpComponent %q should be major, minor or patch", bump)
+		}
+	}
+
+	if resets == nil {
+		resets = append([]string{}, semVerComponents[s.bump+1:]...)
+	}
+	for _, reset := range resets {
+		valid := false
+		for _, name := range semVerComponents {
+			valid = valid || name == reset
+		}
+		if !valid {
+			return s, fmt.Errorf("resetComponents %q should be one of %v", reset, semVerComponents)
+		}
+	}
+	s.resets = resets
+	return s, nil
+}
+
+func (s semVerScheme) Build(v string) (string, error) {
+	parsed, err := parseSemVer(v)
+	if err != nil {
+		return "", err
+	}
+	return strconv.Itoa(parsed.numbers[s.bump]), nil
+}
+
+func (s semVerScheme) NextBuild(build string) (string, error) {
+	n, err := strconv.Atoi(build)
+	if err != nil {
+		return "", fmt.Errorf("build %q is not a number", build)
+	}
+	return strconv.Itoa(n + 1), nil
+}
+
+func (s semVerScheme) Release(v string, build string) (string, error) {
+	parsed, err := parseSemVer(v)
+	if err != nil {
+		return "", err
+	}
+	n, err := strconv.Atoi(build)
+	if err != nil {
+		return "", fmt.Errorf("build %q is not a number", build)
+	}
+
+	parsed.numbers[s.bump] = n
+	for _, reset := range s.resets {
+		switch reset {
+		case "prerelease":
+			parsed.preRelease = ""
+		case "build":
+			parsed.metadata = ""
+		default:
+			for i, name := range semVerComponents[:3] {
+				if name == reset {
+					parsed.numbers[i] = 0
+				}
+			}
+		}
+	}
+	return parsed.String(), nil
+}
+
+func (s semVerScheme) IsRelease(v string) (bool, error) {
+	parsed, err := parseSemVer(v)
+	if err != nil {
+		return false, err
+	}
+	for _, reset := range s.resets {
+		switch reset {
+		case "prerelease":
+			if parsed.preRelease != "" {
+				return false, nil
+			}
+		case "build":
+			if parsed.metadata != "" {
+				return false, nil
+			}
+		default:
+			for i, name := range semVerComponents[:3] {
+				if name == reset && parsed.numbers[i] != 0 {
+					return false, nil
+				}
+			}
+		}
+	}
+	return true, nil
+}
+
+// Compare follows SemVer 2.0 precedence, build metadata is ignored.
+func (s semVerScheme) Compare(a string, b string) (int, error) {
+	x, err := parseSemVer(a)
+	if err != nil {
+		return 0, err
+	}
+	y, err := parseSemVer(b)
+	if err != nil {
+		return 0, err
+	}
+
+	for i := range x.numbers {
+		if c := compareInt(x.numbers[i], y.numbers[i]); c != 0 {
+			return c, nil
+		}
+	}
+
+	// a pre-release has lower precedence than the normal version
+	switch {
+	case x.preRelease == y.preRelease:
+		return 0, nil
+	case x.preRelease == "":
+		return 1, nil
+	case y.preRelease == "":
+		return -1, nil
+	}
+
+	xs := strings.Split(x.preRelease, ".")
+	ys := strings.Split(y.preRelease, ".")
+	for i := 0; i < len(xs) && i < len(ys); i++ {
+		xn, xErr := strconv.Atoi(xs[i])
+		yn, yErr := strconv.Atoi(ys[i])
+		switch {
+		case xErr == nil && yErr == nil:
+			if c := compareInt(xn, yn); c != 0 {
+				return c, nil
+			}
+		case xErr == nil:
+			return -1, nil
+		case yErr == nil:
+			return 1, nil
+		default:
+			if c := strings.Compare(xs[i], ys[i]); c != 0 {
+				return c, nil
+			}
+		}
+	}
+	return compareInt(len(xs), len(ys)), nil
+}
+
+func (s semVerScheme) MasterVersion(relVersion string) (string, error) {
+	_, err := parseSemVer(relVersion)
+	return relVersion, err
+}
+
+// NextRevision bumps patch, pre-release and build metadata are dropped.
+func (s semVerScheme) NextRevision(v string) (string, error) {
+	parsed, err := parseSemVer(v)
+	if err != nil {
+		return "", err
+	}
+	parsed.numbers[2]++
+	parsed.preRelease = ""
+	parsed.metadata = ""
+	return parsed.String(), nil
+}
+
+// calVerScheme derives the version from the release date, in a format
+// of dot separated tokens: YYYY, YY, MM, DD, WW (ISO week, with the ISO
+// year), N, which counts releases with the same date parts, and R, which
+// counts the hotfixes of a release. The whole version but R is the build.
+type calVerScheme struct {
+	format []string
+	// date is the release date of this train, next of the following one
+	date time.Time
+	next time.Time
+}
+
+var calVerTokens = []string{"YYYY", "YY", "MM", "DD", "WW", "N", "R"}
+
+func newCalVerScheme(format string, date time.Time, next time.Time) (calVerScheme, error) {
+	if format == "" {
+		format = "YYYY.MM.N"
+	}
+
+	s := calVerScheme{format: strings.Split(format, "."), date: date, next: next}
+	for _, token := range s.format {
+		valid := false
+		for _, t := range calVerTokens {
+			valid = valid || t == token
+		}
+		if !valid {
+			return s, fmt.Errorf("calVerFormat %q: unknown token %q, should be one of %v", format, token, calVerTokens)
+		}
+	}
+	return s, nil
+}
+
+func (s calVerScheme) parse(v string) ([]int, error) {
+	numbers, err := parseNumeric(v)
+	if err != nil {
+		return nil, err
+	}
+	if len(numbers) != len(s.format) {
+		return nil, fmt.Errorf("version %q is not %s", v, strings.Join(s.format, "."))
+	}
+	return numbers, nil
+}
+
+// dateValue returns the value of token for date.
+func (s calVerScheme) dateValue(token string, date time.Time) int {
+	isoYear, week := date.ISOWeek()
+	year := date.Year()
+	for _, t := range s.format {
+		if t == "WW" {
+			year = isoYear
+		}
+	}
+
+	switch token {
+	case "YYYY":
+		return year
+	case "YY":
+		return year % 100
+	case "MM":
+		return int(date.Month())
+	case "DD":
+		return date.Day()
+	case "WW":
+		return week
+	default:
+		return 0
+	}
+}
+
+func (s calVerScheme) sameDate(numbers []int, date time.Time) bool {
+	for i, token := range s.format {
+		if token != "N" && token != "R" && numbers[i] != s.dateValue(token, date) {
+			return false
+		}
+	}
+	return true
+}
+
+// layout writes numbers with the zero padding of their tokens.
+func (s calVerScheme) layout(numbers []int) string {
+	parts := make([]string, len(s.format))
+	for i, token := range s.format {
+		switch token {
+		case "YYYY":
+			parts[i] = fmt.Sprintf("%04d", numbers[i])
+		case "N", "R":
+			parts[i] = strconv.Itoa(numbers[i])
+		default:
+			parts[i] = fmt.Sprintf("%02d", numbers[i])
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+func (s calVerScheme) forDate(date time.Time, n int) string {
+	numbers := make([]int, len(s.format))
+	for i, token := range s.format {
+		if token == "N" {
+			numbers[i] = n
+		} else {
+			numbers[i] = s.dateValue(token, date)
+		}
+	}
+	return s.layout(numbers)
+}
+
+// Build returns v with R at 0, a hotfix stays in the train of its release.
+func (s calVerScheme) Build(v string) (string, error) {
+	numbers, err := s.parse(v)
+	if err != nil {
+		return "", err
+	}
+	for i, token := range s.format {
+		if token == "R" && numbers[i] != 0 {
+			numbers[i] = 0
+			return s.layout(numbers), nil
+		}
+	}
+	return v, nil
+}
+
+// after returns the version for date following build, counting up N if
+// build is from the same date.
+func (s calVerScheme) after(build string, date time.Time) (string, error) {
+	numbers, err := s.parse(build)
+	if err != nil {
+		return "", err
+	}
+
+	if !s.sameDate(numbers, date) {
+		return s.forDate(date, 0), nil
+	}
+	for i, token := range s.format {
+		if token == "N" {
+			return s.forDate(date, numbers[i]+1), nil
+		}
+	}
+	return build, nil
+}
+
+func (s calVerScheme) NextBuild(build string) (string, error) {
+	return s.after(build, s.date)
+}
+
+func (s calVerScheme) Release(v string, build string) (string, error) {
+	if _, err := s.parse(build); err != nil {
+		return "", err
+	}
+	return build, nil
+}
+
+// IsRelease reports whether v already carries the release date.
+func (s calVerScheme) IsRelease(v string) (bool, error) {
+	numbers, err := s.parse(v)
+	if err != nil {
+		return false, err
+	}
+	return s.sameDate(numbers, s.date), nil
+}
+
+func (s calVerScheme) Compare(a string, b string) (int, error) {
+	if _, err := s.parse(a); err != nil {
+		return 0, err
+	}
+	if _, err := s.parse(b); err != nil {
+		return 0, err
+	}
+	return numericScheme{}.Compare(a, b)
+}
+
+// MasterVersion moves master on to the next train.
+func (s calVerScheme) MasterVersion(relVersion string) (string, error) {
+	return s.after(relVersion, s.next)
+}
+
+// NextRevision counts up R. N cannot count hotfixes, master moves on to
+// the next N after a cut and the hotfix would take its version.
+func (s calVerScheme) NextRevision(v string) (string, error) {
+	numbers, err := s.parse(v)
+	if err != nil {
+		return "", err
+	}
+	for i, token := range s.format {
+		if token == "R" {
+			numbers[i]++
+			return s.layout(numbers), nil
+		}
+	}
+	return "", fmt.Errorf("calVerFormat %s has no R to count hotfixes", strings.Join(s.format, "."))
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+// fuzzScheme checks that a cut for a build and the build after it read
+// back through Build.
+func fuzzScheme(f *testing.F, scheme versionScheme, seeds ...string) {
+	for _, seed := range seeds {
+		f.Add(seed, uint16(7))
+	}
+	f.Fuzz(func(t *testing.T, v string, n uint16) {
+		if _, err := scheme.Build(v); err != nil {
+			return
+		}
+		build := strconv.Itoa(int(n))
+
+		released, err := scheme.Release(v, build)
+		if err != nil {
+			t.Fatalf("Release(%q, %q): %v", v, build, err)
+		}
+		if got, err := scheme.Build(released); err != nil || got != build {
+			t.Fatalf("Build(Release(%q, %q)) = %q, %v", v, build, got, err)
+		}
+		if isRelease, err := scheme.IsRelease(released); err != nil || !isRelease {
+			t.Fatalf("IsRelease(%q) = %v, %v", released, isRelease, err)
+		}
+
+		next, err := scheme.NextBuild(build)
+		if err != nil {
+			t.Fatalf("NextBuild(%q): %v", build, err)
+		}
+		nextReleased, err := scheme.Release(released, next)
+		if err != nil {
+			t.Fatalf("Release(%q, %q): %v", released, next, err)
+		}
+		if got, err := scheme.Build(nextReleased); err != nil || got != next {
+			t.Fatalf("Build(Release(%q, %q)) = %q, %v", released, next, got, err)
+		}
+		if order, err := scheme.Compare(nextReleased, released); err != nil || order <= 0 {
+			t.Fatalf("Compare(%q, %q) = %v, %v", nextReleased, released, order, err)
+		}
+	})
+}
+
+func FuzzNumericScheme(f *testing.F) {
+	scheme, err := newNumericScheme("", nil)
+	if err != nil {
+		f.Fatal(err)
+	}
+	fuzzScheme(f, scheme, "1.2.3.4", "10.0", "0.0.0.0.1")
+}
+
+func FuzzSemVerScheme(f *testing.F) {
+	scheme, err := newSemVerScheme("", nil)
+	if err != nil {
+		f.Fatal(err)
+	}
+	fuzzScheme(f, scheme, "1.2.3", "1.2.3-beta.1+build.5", "0.0.0")
+}
+
+func TestCalVerNextRevision(t *testing.T) {
+	tests := []struct {
+		format string
+		v      string
+		want   string
+		build  string
+	}{
+		{"YYYY.MM.DD.N.R", "2024.05.17.0.0", "2024.05.17.0.1", "2024.05.17.0.0"},
+		{"YYYY.MM.N.R", "2024.05.9.3", "2024.05.9.4", "2024.05.9.0"},
+		{"YY.WW.R", "24.02.3", "24.02.4", "24.02.0"},
+	}
+	for _, tt := range tests {
+		s, err := newCalVerScheme(tt.format, time.Now(), time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := s.NextRevision(tt.v)
+		if err != nil || got != tt.want {
+			t.Errorf("%s NextRevision(%q) = %q, %v, want %q", tt.format, tt.v, got, err, tt.want)
+		}
+		if build, err := s.Build(got); err != nil || build != tt.build {
+			t.Errorf("%s Build(%q) = %q, %v, want %q", tt.format, got, build, err, tt.build)
+		}
+	}
+
+	// N counts the trains, master already carries the next one
+	s, err := newCalVerScheme("YYYY.MM.N", time.Now(), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.NextRevision("2024.05.0"); err == nil {
+		t.Errorf("YYYY.MM.N NextRevision(2024.05.0) = %q, want an error", got)
+	}
+}
+
+func TestNumericScheme(t *testing.T) {
+	tests := []struct {
+		bump      string
+		resets    []string
+		v         string
+		build     string
+		release   string
+		isRelease bool
+	}{
+		{"", nil, "1.2.3.4", "3", "1.2.7.0", false},
+		{"", nil, "1.2.5.0", "5", "1.2.7.0", true},
+		{"0", nil, "1.2.3", "1", "7.0.0", false},
+		{"1", []string{"-1"}, "1.2.3.4", "2", "1.7.3.0", false},
+		{"1", []string{"-1"}, "1.2.3.0", "2", "1.7.3.0", true},
+		{"-1", nil, "10.0", "0", "10.7", true},
+	}
+
+	for _, tt := range tests {
+		s, err := newNumericScheme(tt.bump, tt.resets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := s.Build(tt.v); err != nil || got != tt.build {
+			t.Errorf("bump %q Build(%q) = %q, %v, want %q", tt.bump, tt.v, got, err, tt.build)
+		}
+		if got, err := s.Release(tt.v, "7"); err != nil || got != tt.release {
+			t.Errorf("bump %q resets %q Release(%q, 7) = %q, %v, want %q", tt.bump, tt.resets, tt.v, got, err, tt.release)
+		}
+		if got, err := s.IsRelease(tt.v); err != nil || got != tt.isRelease {
+			t.Errorf("bump %q resets %q IsRelease(%q) = %v, %v, want %v", tt.bump, tt.resets, tt.v, got, err, tt.isRelease)
+		}
+	}
+}
+
+func TestNumericSchemeErrors(t *testing.T) {
+	if _, err := newNumericScheme("minor", nil); err == nil {
+		t.Error("bump component minor accepted")
+	}
+	if _, err := newNumericScheme("", []string{"x"}); err == nil {
+		t.Error("reset component x accepted")
+	}
+
+	s, err := newNumericScheme("5", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Build("1.2"); err == nil {
+		t.Error("Build of a version without the bump component succeeded")
+	}
+	if _, err := s.Build("1.x"); err == nil {
+		t.Error("Build of a version which is not numeric succeeded")
+	}
+}
+
+func TestNumericSchemeCompare(t *testing.T) {
+	tests := []struct {
+		a    string
+		b    string
+		want int
+	}{
+		{"1.2.10", "1.2.9", 1},
+		{"1.2.9", "1.2.10", -1},
+		{"1.2", "1.2.0", -1},
+		{"1.2.3", "1.2.3", 0},
+	}
+
+	s, err := newNumericScheme("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		if got, err := s.Compare(tt.a, tt.b); err != nil || got != tt.want {
+			t.Errorf("Compare(%q, %q) = %v, %v, want %v", tt.a, tt.b, got, err, tt.want)
+		}
+	}
+	if got, err := s.NextRevision("1.2.3.4"); err != nil || got != "1.2.3.5" {
+		t.Errorf("NextRevision(1.2.3.4) = %q, %v", got, err)
+	}
+}
+
+func TestSemVerScheme(t *testing.T) {
+	tests := []struct {
+		bump      string
+		resets    []string
+		v         string
+		build     string
+		release   string
+		isRelease bool
+	}{
+		{"", nil, "1.4.2-rc.1+b5", "4", "1.7.0", false},
+		{"", nil, "1.4.0", "4", "1.7.0", true},
+		{"major", nil, "1.4.2", "1", "7.0.0", false},
+		{"major", nil, "2.0.0", "2", "7.0.0", true},
+		{"patch", []string{"build"}, "1.4.2-rc.1+b5", "2", "1.4.7-rc.1", false},
+		{"patch", []string{"build"}, "1.4.2-rc.1", "2", "1.4.7-rc.1", true},
+		{"minor", []string{"patch"}, "1.4.0-beta", "4", "1.7.0-beta", true},
+	}
+
+	for _, tt := range tests {
+		s, err := newSemVerScheme(tt.bump, tt.resets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := s.Build(tt.v); err != nil || got != tt.build {
+			t.Errorf("bump %q Build(%q) = %q, %v, want %q", tt.bump, tt.v, got, err, tt.build)
+		}
+		if got, err := s.Release(tt.v, "7"); err != nil || got != tt.release {
+			t.Errorf("bump %q resets %q Release(%q, 7) = %q, %v, want %q", tt.bump, tt.resets, tt.v, got, err, tt.release)
+		}
+		if got, err := s.IsRelease(tt.v); err != nil || got != tt.isRelease {
+			t.Errorf("bump %q resets %q IsRelease(%q) = %v, %v, want %v", tt.bump, tt.resets, tt.v, got, err, tt.isRelease)
+		}
+	}
+}
+
+func TestSemVerSchemeErrors(t *testing.T) {
+	if _, err := newSemVerScheme("prerelease", nil); err == nil {
+		t.Error("bump component prerelease accepted")
+	}
+	if _, err := newSemVerScheme("", []string{"revision"}); err == nil {
+		t.Error("reset component revision accepted")
+	}
+
+	s, err := newSemVerScheme("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"1.2", "01.2.3", "1.2.3-", "1.2.3-01", "v1.2.3"} {
+		if _, err := s.Build(v); err == nil {
+			t.Errorf("Build(%q) of an invalid version succeeded", v)
+		}
+	}
+}
+
+func TestSemVerSchemeCompare(t *testing.T) {
+	// the precedence example of SemVer 2.0, lowest first
+	ordered := []string{"1.0.0-alpha", "1.0.0-alpha.1", "1.0.0-alpha.beta", "1.0.0-beta", "1.0.0-beta.2", "1.0.0-beta.11", "1.0.0-rc.1", "1.0.0", "1.0.1", "1.1.0", "2.0.0"}
+
+	s, err := newSemVerScheme("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < len(ordered); i++ {
+		a, b := ordered[i-1], ordered[i]
+		if got, err := s.Compare(a, b); err != nil || got != -1 {
+			t.Errorf("Compare(%q, %q) = %v, %v, want -1", a, b, got, err)
+		}
+		if got, err := s.Compare(b, a); err != nil || got != 1 {
+			t.Errorf("Compare(%q, %q) = %v, %v, want 1", b, a, got, err)
+		}
+	}
+	if got, err := s.Compare("1.0.0+a", "1.0.0+b"); err != nil || got != 0 {
+		t.Errorf("Compare ignoring build metadata = %v, %v, want 0", got, err)
+	}
+	if got, err := s.NextRevision("1.4.2-rc.1+b5"); err != nil || got != "1.4.3" {
+		t.Errorf("NextRevision(1.4.2-rc.1+b5) = %q, %v", got, err)
+	}
+}
+
+func TestCalVerScheme(t *testing.T) {
+	date := time.Date(2024, time.May, 17, 0, 0, 0, 0, time.UTC)
+	next := date.AddDate(0, 0, 7)
+
+	tests := []struct {
+		format    string
+		v         string
+		nextBuild string
+		isRelease bool
+		master    string
+	}{
+		{"YYYY.MM.N", "2024.04.3", "2024.05.0", false, "2024.05.0"},
+		{"YYYY.MM.N", "2024.05.0", "2024.05.1", true, "2024.05.1"},
+		{"YYYY.MM.DD.N", "2024.05.10.2", "2024.05.17.0", false, "2024.05.24.0"},
+		{"YYYY.MM.DD.N", "2024.05.17.0", "2024.05.17.1", true, "2024.05.24.0"},
+		{"YY.WW.N", "24.19.2", "24.20.0", false, "24.21.0"},
+		{"YY.MM.DD", "24.05.17", "24.05.17", true, "24.05.24"},
+	}
+
+	for _, tt := range tests {
+		s, err := newCalVerScheme(tt.format, date, next)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := s.NextBuild(tt.v); err != nil || got != tt.nextBuild {
+			t.Errorf("%s NextBuild(%q) = %q, %v, want %q", tt.format, tt.v, got, err, tt.nextBuild)
+		}
+		if got, err := s.IsRelease(tt.v); err != nil || got != tt.isRelease {
+			t.Errorf("%s IsRelease(%q) = %v, %v, want %v", tt.format, tt.v, got, err, tt.isRelease)
+		}
+		if got, err := s.MasterVersion(tt.v); err != nil || got != tt.master {
+			t.Errorf("%s MasterVersion(%q) = %q, %v, want %q", tt.format, tt.v, got, err, tt.master)
+		}
+	}
+}
+
+func TestCalVerSchemeISOWeekYear(t *testing.T) {
+	// 30 December 2024 is in week 1 of 2025
+	date := time.Date(2024, time.December, 30, 0, 0, 0, 0, time.UTC)
+	s, err := newCalVerScheme("YYYY.WW.N", date, date.AddDate(0, 0, 7))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.NextBuild("2024.52.1"); err != nil || got != "2025.01.0" {
+		t.Errorf("NextBuild(2024.52.1) = %q, %v, want 2025.01.0", got, err)
+	}
+}
+
+func TestCalVerSchemeErrors(t *testing.T) {
+	if _, err := newCalVerScheme("YYYY.Q.N", time.Now(), time.Now()); err == nil {
+		t.Error("format YYYY.Q.N accepted")
+	}
+
+	s, err := newCalVerScheme("YYYY.MM.N", time.Now(), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Build("2024.05"); err == nil {
+		t.Error("Build of a version without N succeeded")
+	}
+	if got, err := s.Compare("2024.05.10", "2024.05.9"); err != nil || got != 1 {
+		t.Errorf("Compare(2024.05.10, 2024.05.9) = %v, %v, want 1", got, err)
+	}
+
+	noRevision, err := newCalVerScheme("YYYY.MM.DD", time.Now(), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := noRevision.NextRevision("2024.05.17"); err == nil {
+		t.Error("NextRevision without N succeeded")
+	}
+}
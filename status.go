@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const statusMarker = "<!-- vsts-branch status -->"
+
+// runID names this run in PR status comments, the pipeline build id when
+// run from a pipeline.
+var runID = func() string {
+	if id := os.Getenv("BUILD_BUILDID"); id != "" {
+		return id
+	}
+	return fmt.Sprintf("%s-%v", time.Now().UTC().Format("20060102T150405Z"), os.Getpid())
+}()
+
+// prStatus is what the tool did to a PR, shown in its status comment.
+type prStatus struct {
+	Action        string
+	RelBranch     string
+	VersionBefore string
+	VersionAfter  string
+	Commits       []string
+	BuildID       int
+}
+
+// postedStatus is the status last posted to a PR, for a later update.
+type postedStatus struct {
+	PullRequestID int
+	Status        prStatus
+}
+
+func (s prStatus) content() string {
+	b := new(strings.Builder)
+	fmt.Fprintf(b, "%s\n**vsts-branch:** %s\n\n", statusMarker, s.Action)
+	fmt.Fprintf(b, "| | |\n| --- | --- |\n")
+	fmt.Fprintf(b, "| Release branch | %s |\n", s.RelBranch)
+	if s.VersionBefore != "" || s.VersionAfter != "" {
+		fmt.Fprintf(b, "| Version | %s → %s |\n", s.VersionBefore, s.VersionAfter)
+	}
+	if s.BuildID != 0 {
+		fmt.Fprintf(b, "| Build queued | %v |\n", s.BuildID)
+	}
+	fmt.Fprintf(b, "| Run | %s |\n", runID)
+	if len(s.Commits) > 0 {
+		fmt.Fprintf(b, "\nCommits:\n\n- %s\n", strings.Join(s.Commits, "\n- "))
+	}
+	return b.String()
+}
+
+// postStatus writes the status comment of a PR, updating the thread of an
+// earlier run instead of starting another one.
+func postStatus(client *http.Client, repo repoConfig, pullRequestID int, status prStatus) {
+	content := status.content()
+	for _, thread := range getPullRequestThreads(client, repo, pullRequestID).Value {
+		if len(thread.Comments) == 0 || !strings.HasPrefix(thread.Comments[0].Content, statusMarker) {
+			continue
+		}
+		updatePullRequestComment(client, repo, pullRequestID, thread.ID, thread.Comments[0].ID, content)
+		return
+	}
+	postPullRequestThread(client, repo, pullRequestID, content, "closed")
+}
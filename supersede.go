@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// previousReleaseBranch returns the newest release branch older than
+// relBranch.
+func previousReleaseBranch(client *http.Client, repo repoConfig, relBranch string) string {
+	previous := ""
+	for _, name := range releaseBranches(client, repo) {
+		if name < relBranch {
+			previous = name
+		}
+	}
+	return previous
+}
+
+// supersededMarker is the tag supersedePullRequests leaves on relBranch
+// once the PRs into the branch it replaces were dealt with.
+func supersededMarker(relBranch string) string {
+	return fmt.Sprintf("%s/%s", "refs/tags/release-superseded", relBranch)
+}
+
+// supersedePullRequests deals with the active PRs into the release branch
+// relBranch replaces, by the supersededPullRequests policy. Hotfix and
+// backport PRs of this tool are meant for the old branch and left alone.
+// It runs once per release branch, also when the cut continues on a branch
+// created by an earlier run, and again only if a retarget failed.
+func supersedePullRequests(client *http.Client, repo repoConfig, relBranch string, commitID string) {
+	marker := supersededMarker(relBranch)
+	if _, found := findRef(client, repo, marker); found {
+		fmt.Printf("PRs superseded by %s were already dealt with.\n", relBranch)
+		return
+	}
+
+	policy := repo.SupersededPullRequests
+	if policy == "" {
+		policy = "report"
+	}
+	if policy != "retarget" && policy != "abandon" && policy != "report" {
+		fmt.Printf("Unknown supersededPullRequests %q, only reporting.\n", policy)
+		policy = "report"
+	}
+
+	succeeded := true
+	previous := previousReleaseBranch(client, repo, relBranch)
+	if previous != "" {
+		for _, pr := range searchPullRequests(client, repo, "Active", previous, "", 100).Value {
+			source := strings.TrimPrefix(pr.SourceRefName, "refs/heads/")
+			if strings.HasPrefix(source, "hotfix/") || strings.HasPrefix(source, "backport/") {
+				continue
+			}
+
+			switch policy {
+			case "retarget":
+				if !retargetPullRequest(client, repo, pr.PullRequestID, relBranch) {
+					succeeded = false
+					continue
+				}
+				content := fmt.Sprintf("%s was superseded by %s, vsts-branch retargeted this PR.", previous, relBranch)
+				postPullRequestThread(client, repo, pr.PullRequestID, content, "closed")
+			case "abandon":
+				content := fmt.Sprintf("%s was superseded by %s, vsts-branch abandoned this PR. Please open it against %s if it is still needed.", previous, relBranch, relBranch)
+				postPullRequestThread(client, repo, pr.PullRequestID, content, "closed")
+				abandonPullRequest(client, repo, pr.PullRequestID)
+			default:
+				fmt.Printf("PR %v from %s still targets %s: %s\n", pr.PullRequestID, source, previous, pr.Title)
+			}
+		}
+	}
+
+	if succeeded && !updateRef(client, repo, marker, zeroObjectID, commitID) {
+		fmt.Printf("Warning: failed to mark superseded PRs of %s\n", relBranch)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// releaseTagName fills {repo}, {branch} and {version} in template.
+func releaseTagName(template string, repo repoConfig, relBranch string, relVersion string) string {
+	r := strings.NewReplacer(
+		"{repo}", repo.Repo,
+		"{branch}", relBranch,
+		"{version}", relVersion)
+	return r.Replace(template)
+}
+
+// ensureTag creates an annotated tag at commitID unless it is already
+// there. A tag of the same name on another commit is an error.
+func ensureTag(client *http.Client, repo repoConfig, name string, commitID string, message string) bool {
+	tag, found := getTag(client, repo, name)
+	if !found {
+		return createAnnotatedTag(client, repo, name, commitID, message)
+	}
+
+	tagged := tag.PeeledObjectID
+	if tagged == "" {
+		tagged = tag.ObjectID
+	}
+	if tagged != commitID {
+		fmt.Printf("Tag %s already exists at %s, not %s\n", name, tagged, commitID)
+		return false
+	}
+
+	fmt.Printf("Tag %s already exists.\n", name)
+	return true
+}
+
+// releaseTagTemplates returns the fork and version tag templates of repo.
+func releaseTagTemplates(repo repoConfig) (string, string) {
+	forkTemplate := repo.ForkTagTemplate
+	if forkTemplate == "" {
+		forkTemplate = "fork/{branch}"
+	}
+	versionTemplate := repo.VersionTagTemplate
+	if versionTemplate == "" {
+		versionTemplate = "v{version}"
+	}
+	return forkTemplate, versionTemplate
+}
+
+// createReleaseTags tags the fork point of relBranch and its version
+// reset commit. forkCommitID may be empty when the branch was cut by an
+// earlier run, it is then looked up only if the fork tag is missing. The
+// tags carry the version of the reset commit, relVersion is only used
+// when there is none: the branch head may be at a hotfix version since.
+func createReleaseTags(client *http.Client, repo repoConfig, relBranch string, forkCommitID string, relVersion string) bool {
+	forkTemplate, versionTemplate := releaseTagTemplates(repo)
+
+	// the version tag goes on the reset commit, found by its marker
+	marker := versionResetMarker(relBranch)
+	m, found := findRef(client, repo, marker)
+	resetCommitID := m.ObjectID
+	if found {
+		resetVersion, err := commitReleaseVersion(client, repo, resetCommitID)
+		if err != nil {
+			fmt.Printf("Error version file: %v\n", err)
+			return false
+		}
+		relVersion = resetVersion
+	}
+
+	succeeded := true
+
+	forkTag := releaseTagName(forkTemplate, repo, relBranch, relVersion)
+	if _, found := getTag(client, repo, forkTag); !found && forkCommitID == "" {
+		forkCommitID = getDiffsBetweenBranches(client, repo, repo.MasterBranch, relBranch).CommonCommit
+	}
+	if forkCommitID != "" && !ensureTag(client, repo, forkTag, forkCommitID, fmt.Sprintf("%s forked from %s", relBranch, repo.MasterBranch)) {
+		succeeded = false
+	}
+
+	if resetCommitID == "" {
+		fmt.Printf("No version reset commit of %s to tag.\n", relBranch)
+		return succeeded
+	}
+
+	versionTag := releaseTagName(versionTemplate, repo, relBranch, relVersion)
+	if !ensureTag(client, repo, versionTag, resetCommitID, fmt.Sprintf("Version %s for release %s", relVersion, relBranch)) {
+		succeeded = false
+	}
+
+	return succeeded
+}
+
+// commitReleaseVersion returns the build version entry of the version
+// file at commitID.
+func commitReleaseVersion(client *http.Client, repo repoConfig, commitID string) (string, error) {
+	versionFile, err := getCommitVersionFile(client, repo, commitID)
+	if err != nil {
+		return "", err
+	}
+	v, err := buildVersion(repo, versionFile)
+	if err != nil {
+		return "", err
+	}
+	return v.Value, nil
+}
+
+// deleteTag removes tag name if it points at commitID, so a tag which
+// was moved or reused by hand is left alone.
+func deleteTag(client *http.Client, repo repoConfig, name string, commitID string) bool {
+	tag, found := getTag(client, repo, name)
+	if !found {
+		return true
+	}
+
+	tagged := tag.PeeledObjectID
+	if tagged == "" {
+		tagged = tag.ObjectID
+	}
+	if tagged != commitID {
+		fmt.Printf("Tag %s is at %s, not %s, keep it.\n", name, tagged, commitID)
+		return true
+	}
+
+	fmt.Printf("Delete tag %s\n", name)
+	return updateRef(client, repo, tag.Name, tag.ObjectID, zeroObjectID)
+}
+
+// deleteReleaseTags removes the tags createReleaseTags put on the fork
+// point and the version reset commit of relBranch, so the release can be
+// cut again from another commit. relVersion may be empty when the version
+// is unknown, the version tag is then kept.
+func deleteReleaseTags(client *http.Client, repo repoConfig, relBranch string, forkCommitID string, resetCommitID string, relVersion string) bool {
+	forkTemplate, versionTemplate := releaseTagTemplates(repo)
+
+	succeeded := true
+	if forkCommitID != "" && !deleteTag(client, repo, releaseTagName(forkTemplate, repo, relBranch, relVersion), forkCommitID) {
+		succeeded = false
+	}
+	if resetCommitID != "" && relVersion != "" && !deleteTag(client, repo, releaseTagName(versionTemplate, repo, relBranch, relVersion), resetCommitID) {
+		succeeded = false
+	}
+	return succeeded
+}
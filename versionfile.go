@@ -0,0 +1,453 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// versionFile is a parsed version file which can be edited and written back.
+type versionFile interface {
+	// Versions returns the named version entries in file order.
+	Versions() []version
+	// SetVersion sets the value of every entry called name.
+	SetVersion(name string, value string) error
+	// Marshal returns the file content to push.
+	Marshal() ([]byte, error)
+}
+
+type version struct {
+	Name  string
+	Value string
+}
+
+// xmlVersionFile edits the value attributes of
+// <versions><version name="" value=""/></versions> in place, so the
+// declaration, comments, other attributes and whitespace survive.
+type xmlVersionFile struct {
+	content []byte
+}
+
+type xmlVersionMatch struct {
+	version
+	// start and end of the value attribute content
+	start int
+	end   int
+}
+
+// xmlAttrValue returns the offsets of the content of attribute name in
+// the start tag, walking the attributes in order so text inside another
+// attribute's quotes is never taken for it.
+func xmlAttrValue(tag []byte, name string) (int, int, bool) {
+	isSpace := func(c byte) bool { return c == ' ' || c == '\t' || c == '\r' || c == '\n' }
+
+	i := 1 // past "<"
+	for i < len(tag) && !isSpace(tag[i]) && tag[i] != '/' && tag[i] != '>' {
+		i++
+	}
+	for {
+		for i < len(tag) && isSpace(tag[i]) {
+			i++
+		}
+		if i >= len(tag) || tag[i] == '/' || tag[i] == '>' {
+			return 0, 0, false
+		}
+
+		nameStart := i
+		for i < len(tag) && !isSpace(tag[i]) && tag[i] != '=' {
+			i++
+		}
+		attr := string(tag[nameStart:i])
+		for i < len(tag) && isSpace(tag[i]) {
+			i++
+		}
+		if i >= len(tag) || tag[i] != '=' {
+			return 0, 0, false
+		}
+		i++
+		for i < len(tag) && isSpace(tag[i]) {
+			i++
+		}
+		if i >= len(tag) || (tag[i] != '"' && tag[i] != '\'') {
+			return 0, 0, false
+		}
+
+		quote := tag[i]
+		start := i + 1
+		end := bytes.IndexByte(tag[start:], quote)
+		if end < 0 {
+			return 0, 0, false
+		}
+		end += start
+		if attr == name {
+			return start, end, true
+		}
+		i = end + 1
+	}
+}
+
+func (f *xmlVersionFile) matches() ([]xmlVersionMatch, error) {
+	matches := []xmlVersionMatch{}
+	stack := []string{}
+
+	d := xml.NewDecoder(bytes.NewReader(f.content))
+	for {
+		start := d.InputOffset()
+		t, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch e := t.(type) {
+		case xml.StartElement:
+			stack = append(stack, e.Name.Local)
+			if len(stack) != 3 || stack[1] != "versions" || stack[2] != "version" {
+				continue
+			}
+
+			m := xmlVersionMatch{}
+			for _, attr := range e.Attr {
+				switch attr.Name.Local {
+				case "name":
+					m.Name = attr.Value
+				case "value":
+					m.Value = attr.Value
+				}
+			}
+
+			tag := f.content[start:d.InputOffset()]
+			valueStart, valueEnd, ok := xmlAttrValue(tag, "value")
+			if !ok {
+				return nil, fmt.Errorf("version %q has no value", m.Name)
+			}
+			m.start, m.end = int(start)+valueStart, int(start)+valueEnd
+			matches = append(matches, m)
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+		}
+	}
+	return matches, nil
+}
+
+func (f *xmlVersionFile) Versions() []version {
+	matches, _ := f.matches()
+	versions := []version{}
+	for _, m := range matches {
+		versions = append(versions, m.version)
+	}
+	return versions
+}
+
+func (f *xmlVersionFile) SetVersion(name string, value string) error {
+	matches, err := f.matches()
+	if err != nil {
+		return err
+	}
+
+	escaped := new(bytes.Buffer)
+	xml.EscapeText(escaped, []byte(value))
+
+	content := []byte{}
+	last := 0
+	found := false
+	for _, m := range matches {
+		if m.Name != name {
+			continue
+		}
+		content = append(content, f.content[last:m.start]...)
+		content = append(content, escaped.Bytes()...)
+		last = m.end
+		found = true
+	}
+	if !found {
+		return fmt.Errorf("version %q not found", name)
+	}
+	f.content = append(content, f.content[last:]...)
+	return nil
+}
+
+func (f *xmlVersionFile) Marshal() ([]byte, error) {
+	return f.content, nil
+}
+
+// packageJSONVersionFile edits the top-level "version" of package.json in
+// place. A "version" key of a nested object, like engines or a
+// dependency, is left alone.
+type packageJSONVersionFile struct {
+	content []byte
+}
+
+// match returns the top-level version with the offsets of its string
+// content, ok is false if package.json has none.
+func (f *packageJSONVersionFile) match() (versionMatch, bool, error) {
+	dec := json.NewDecoder(bytes.NewReader(f.content))
+	if t, err := dec.Token(); err != nil {
+		return versionMatch{}, false, err
+	} else if t != json.Delim('{') {
+		return versionMatch{}, false, fmt.Errorf("package.json is not an object")
+	}
+
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return versionMatch{}, false, err
+		}
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return versionMatch{}, false, err
+		}
+		if key != "version" {
+			continue
+		}
+
+		end := int(dec.InputOffset())
+		start := end - len(value)
+		if len(value) < 2 || value[0] != '"' {
+			return versionMatch{}, false, fmt.Errorf("version is not a string: %s", value)
+		}
+		m := versionMatch{start: start + 1, end: end - 1}
+		m.Name = "version"
+		m.Value = string(f.content[m.start:m.end])
+		return m, true, nil
+	}
+	return versionMatch{}, false, nil
+}
+
+func (f *packageJSONVersionFile) Versions() []version {
+	m, ok, err := f.match()
+	if err != nil || !ok {
+		return []version{}
+	}
+	return []version{m.version}
+}
+
+func (f *packageJSONVersionFile) SetVersion(name string, value string) error {
+	m, ok, err := f.match()
+	if err != nil {
+		return err
+	}
+	if !ok || m.Name != name {
+		return fmt.Errorf("version %q not found", name)
+	}
+	content := append([]byte{}, f.content[:m.start]...)
+	content = append(content, value...)
+	f.content = append(content, f.content[m.end:]...)
+	return nil
+}
+
+func (f *packageJSONVersionFile) Marshal() ([]byte, error) {
+	return f.content, nil
+}
+
+// patternVersionFile edits versions found by a regular expression in
+// place, leaving the rest of the file untouched. The pattern must have a
+// "value" group and may have a "name" group, otherwise every entry is
+// called defaultName.
+type patternVersionFile struct {
+	content     []byte
+	pattern     *regexp.Regexp
+	defaultName string
+	// firstOnly stops at the first match, for formats with a single
+	// version.
+	firstOnly bool
+}
+
+type versionMatch struct {
+	version
+	start int
+	end   int
+}
+
+func (f *patternVersionFile) matches() []versionMatch {
+	n := -1
+	if f.firstOnly {
+		n = 1
+	}
+
+	nameIndex := f.pattern.SubexpIndex("name")
+	valueIndex := f.pattern.SubexpIndex("value")
+
+	matches := []versionMatch{}
+	for _, loc := range f.pattern.FindAllSubmatchIndex(f.content, n) {
+		m := versionMatch{
+			start: loc[2*valueIndex],
+			end:   loc[2*valueIndex+1],
+		}
+		m.Name = f.defaultName
+		if nameIndex >= 0 && loc[2*nameIndex] >= 0 {
+			m.Name = string(f.content[loc[2*nameIndex]:loc[2*nameIndex+1]])
+		}
+		m.Value = string(f.content[m.start:m.end])
+		matches = append(matches, m)
+	}
+	return matches
+}
+
+func (f *patternVersionFile) Versions() []version {
+	versions := []version{}
+	for _, m := range f.matches() {
+		versions = append(versions, m.version)
+	}
+	return versions
+}
+
+func (f *patternVersionFile) SetVersion(name string, value string) error {
+	matches := f.matches()
+	content := []byte{}
+	last := 0
+	found := false
+	for _, m := range matches {
+		if m.Name != name {
+			continue
+		}
+		content = append(content, f.content[last:m.start]...)
+		content = append(content, value...)
+		last = m.end
+		found = true
+	}
+	if !found {
+		return fmt.Errorf("version %q not found", name)
+	}
+	f.content = append(content, f.content[last:]...)
+	return nil
+}
+
+func (f *patternVersionFile) Marshal() ([]byte, error) {
+	return f.content, nil
+}
+
+var (
+	// <Version>1.2.3</Version> in Directory.Build.props or a project file
+	msbuildPattern = regexp.MustCompile(`<(?P<name>Version|VersionPrefix|AssemblyVersion|FileVersion)>\s*(?P<value>[^<\s]*)\s*</(?:Version|VersionPrefix|AssemblyVersion|FileVersion)>`)
+	// [assembly: AssemblyVersion("1.2.3.4")] in AssemblyInfo.cs
+	assemblyInfoPattern = regexp.MustCompile(`\[\s*assembly\s*:\s*(?P<name>AssemblyVersion|AssemblyFileVersion|AssemblyInformationalVersion)(?:Attribute)?\s*\(\s*"(?P<value>[^"]*)"\s*\)\s*\]`)
+	// const Version = "1.2.3", also inside a const block
+	goConstPattern = regexp.MustCompile(`(?m)^\s*(?:const\s+)?(?P<name>\w*[Vv]ersion\w*)\s*(?:string\s*)?=\s*"(?P<value>[^"]*)"`)
+	// the first word of a VERSION file
+	plainPattern = regexp.MustCompile(`\A\s*(?P<value>\S+)`)
+)
+
+// buildVersion returns the entry whose value drives the build number.
+func buildVersion(repo repoConfig, versionFile versionFile) (version, error) {
+	versions := versionFile.Versions()
+	if repo.BuildVersionName == "" {
+		if len(versions) != 1 {
+			return version{}, fmt.Errorf("%v versions found, set buildVersionName: %+v", len(versions), versions)
+		}
+		return versions[0], nil
+	}
+
+	for _, v := range versions {
+		if v.Name == repo.BuildVersionName {
+			return v, nil
+		}
+	}
+	return version{}, fmt.Errorf("version %q not found: %+v", repo.BuildVersionName, versions)
+}
+
+// checkVersionNames rejects resetVersionNames that leave out the build
+// version, a reset that does not reset it would be detected as missing on
+// every cut.
+func checkVersionNames(repo repoConfig) error {
+	if len(repo.ResetVersionNames) == 0 {
+		return nil
+	}
+	if repo.BuildVersionName == "" {
+		return fmt.Errorf("%s: resetVersionNames %q set, set buildVersionName too", repo.Repo, repo.ResetVersionNames)
+	}
+	for _, name := range repo.ResetVersionNames {
+		if name == repo.BuildVersionName {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s: resetVersionNames %q do not include buildVersionName %q", repo.Repo, repo.ResetVersionNames, repo.BuildVersionName)
+}
+
+// resetVersions returns the entries reset together for a release, the
+// build version if none are configured.
+func resetVersions(repo repoConfig, versionFile versionFile) ([]version, error) {
+	if err := checkVersionNames(repo); err != nil {
+		return nil, err
+	}
+	if len(repo.ResetVersionNames) == 0 {
+		v, err := buildVersion(repo, versionFile)
+		if err != nil {
+			return nil, err
+		}
+		return []version{v}, nil
+	}
+
+	versions := []version{}
+	for _, name := range repo.ResetVersionNames {
+		found := false
+		for _, v := range versionFile.Versions() {
+			if v.Name == name {
+				versions = append(versions, v)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("version %q not found: %+v", name, versionFile.Versions())
+		}
+	}
+	return versions, nil
+}
+
+// versionFormat returns the configured format of the version file, or
+// guesses it from the file extension.
+func versionFormat(repo repoConfig) string {
+	if repo.VersionFormat != "" {
+		return repo.VersionFormat
+	}
+
+	switch strings.ToLower(path.Ext(repo.VersionPath)) {
+	case ".xml":
+		return "xml"
+	case ".json":
+		return "packagejson"
+	case ".props", ".targets", ".csproj":
+		return "msbuild"
+	case ".cs":
+		return "assemblyinfo"
+	case ".go":
+		return "go"
+	default:
+		return "plain"
+	}
+}
+
+func parseVersionFile(format string, content []byte) (versionFile, error) {
+	switch format {
+	case "xml":
+		f := &xmlVersionFile{content: content}
+		if _, err := f.matches(); err != nil {
+			return nil, err
+		}
+		return f, nil
+	case "packagejson":
+		f := &packageJSONVersionFile{content: content}
+		if _, _, err := f.match(); err != nil {
+			return nil, err
+		}
+		return f, nil
+	case "msbuild":
+		return &patternVersionFile{content: content, pattern: msbuildPattern}, nil
+	case "assemblyinfo":
+		return &patternVersionFile{content: content, pattern: assemblyInfoPattern}, nil
+	case "go":
+		return &patternVersionFile{content: content, pattern: goConstPattern}, nil
+	case "plain":
+		return &patternVersionFile{content: content, pattern: plainPattern, defaultName: "version", firstOnly: true}, nil
+	default:
+		return nil, fmt.Errorf("unknown version format %q", format)
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files of the tests")
+
+func TestXMLVersionFileGolden(t *testing.T) {
+	tests := []struct {
+		file     string
+		versions []version
+		set      []version
+	}{
+		{
+			file:     "declaration",
+			versions: []version{{"product", "1.2.3.4"}},
+			set:      []version{{"product", "1.3.0.0"}},
+		},
+		{
+			file:     "comments",
+			versions: []version{{"product", "1.2.3.4"}},
+			set:      []version{{"product", "1.3.0.0"}},
+		},
+		{
+			file:     "singlequotes",
+			versions: []version{{"product", "1.2.3.4"}},
+			set:      []version{{"product", "1.3.0.0"}},
+		},
+		{
+			file:     "attributes",
+			versions: []version{{"a value='x'", "1.2.3.4"}, {"b", "5.6.7.8"}},
+			set:      []version{{"a value='x'", "9.9"}, {"b", "5.7.0.0"}},
+		},
+		{
+			file:     "siblings",
+			versions: []version{{"product", "1.2.3.4"}},
+			set:      []version{{"product", "1.3.0.0"}},
+		},
+		{
+			file:     "crlf",
+			versions: []version{{"product", "1.2.3.4"}},
+			set:      []version{{"product", "1.3.0.0"}},
+		},
+		{
+			file:     "multiple",
+			versions: []version{{"product", "1.2.3.4"}, {"file", "1.2.3.4"}, {"schema", "7"}, {"product", "1.2.3.4"}},
+			set:      []version{{"product", "1.3.0.0"}, {"file", "1.3.0.0"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			input, err := ioutil.ReadFile(filepath.Join("testdata", "xml", tt.file+".xml"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			vf, err := parseVersionFile("xml", input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := vf.Versions(); !reflect.DeepEqual(got, tt.versions) {
+				t.Errorf("Versions() = %+v, want %+v", got, tt.versions)
+			}
+
+			for _, v := range tt.set {
+				if err := vf.SetVersion(v.Name, v.Value); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got, err := vf.Marshal()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			golden := filepath.Join("testdata", "xml", tt.file+".golden")
+			if *update {
+				if err := ioutil.WriteFile(golden, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("content after SetVersion:\n%s\nwant:\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestXMLVersionFileMissingVersion(t *testing.T) {
+	vf, err := parseVersionFile("xml", []byte(`<root><versions><version name="a" value="1"/></versions></root>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := vf.SetVersion("b", "2"); err == nil {
+		t.Error("SetVersion of a missing name succeeded")
+	}
+}
+
+// fuzzVersionFile checks that parsing never panics and that setting every
+// entry of a name to a plain version reads back without losing entries.
+func fuzzVersionFile(f *testing.F, format string, seeds ...string) {
+	for _, seed := range seeds {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, content []byte) {
+		vf, err := parseVersionFile(format, content)
+		if err != nil {
+			return
+		}
+		versions := vf.Versions()
+		if len(versions) == 0 {
+			return
+		}
+
+		name := versions[0].Name
+		if err := vf.SetVersion(name, "1.2.3"); err != nil {
+			t.Fatalf("SetVersion(%q) of a parsed entry: %v", name, err)
+		}
+		marshaled, err := vf.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		reparsed, err := parseVersionFile(format, marshaled)
+		if err != nil {
+			t.Fatalf("content after SetVersion does not parse: %v\n%s", err, marshaled)
+		}
+		got := reparsed.Versions()
+		if len(got) != len(versions) {
+			t.Fatalf("%v versions after SetVersion, want %v:\n%s", len(got), len(versions), marshaled)
+		}
+		for i, v := range got {
+			want := versions[i]
+			if v.Name == name {
+				want.Value = "1.2.3"
+			}
+			if v != want {
+				t.Fatalf("version %v is %+v after SetVersion, want %+v", i, v, want)
+			}
+		}
+	})
+}
+
+func FuzzParseVersionFileXML(f *testing.F) {
+	fuzzVersionFile(f, "xml",
+		`<?xml version="1.0"?><root><versions><version name="a" value="1.2.3.4"/></versions></root>`,
+		`<root><versions><version name='a value="x"' value='1'/><version value="2" name="b"></version></versions></root>`)
+}
+
+func FuzzParseVersionFilePackageJSON(f *testing.F) {
+	fuzzVersionFile(f, "packagejson",
+		`{"name": "app", "version": "1.2.3"}`,
+		`{"engines": {"version": "1"}, "version": "2.0.0"}`)
+}
+
+func FuzzParseVersionFileMSBuild(f *testing.F) {
+	fuzzVersionFile(f, "msbuild",
+		`<Project><PropertyGroup><Version>1.2.3</Version><FileVersion>1.2.3.4</FileVersion></PropertyGroup></Project>`)
+}
+
+func FuzzParseVersionFileAssemblyInfo(f *testing.F) {
+	fuzzVersionFile(f, "assemblyinfo",
+		"[assembly: AssemblyVersion(\"1.2.3.4\")]\n[assembly: AssemblyFileVersion(\"1.2.3.4\")]\n")
+}
+
+func FuzzParseVersionFileGo(f *testing.F) {
+	fuzzVersionFile(f, "go",
+		"package version\n\nconst Version = \"1.2.3\"\n",
+		"const (\n\tVersion string = \"1.2.3\"\n\tAPIVersion = \"2\"\n)\n")
+}
+
+func FuzzParseVersionFilePlain(f *testing.F) {
+	fuzzVersionFile(f, "plain", "1.2.3.4\n", "  2024.05.1  ")
+}
+
+func TestPackageJSONTopLevelVersion(t *testing.T) {
+	tests := []struct {
+		content string
+		version string
+		want    string
+	}{
+		{
+			content: `{"engines":{"version":"1"},"version":"2.0.0"}`,
+			version: "2.0.0",
+			want:    `{"engines":{"version":"1"},"version":"2.1.0"}`,
+		},
+		{
+			content: "{\n  \"name\": \"app\",\n  \"version\" : \"1.2.3\",\n  \"config\": {\"version\": \"9\"}\n}\n",
+			version: "1.2.3",
+			want:    "{\n  \"name\": \"app\",\n  \"version\" : \"2.1.0\",\n  \"config\": {\"version\": \"9\"}\n}\n",
+		},
+		{
+			content: `{"scripts":["version"],"description":"\"version\": \"0\"","version":"3.0.0"}`,
+			version: "3.0.0",
+			want:    `{"scripts":["version"],"description":"\"version\": \"0\"","version":"2.1.0"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		vf, err := parseVersionFile("packagejson", []byte(tt.content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := vf.Versions(); !reflect.DeepEqual(got, []version{{"version", tt.version}}) {
+			t.Errorf("Versions() of %s = %+v, want %s", tt.content, got, tt.version)
+		}
+		if err := vf.SetVersion("version", "2.1.0"); err != nil {
+			t.Fatal(err)
+		}
+		got, err := vf.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("content after SetVersion:\n%s\nwant:\n%s", got, tt.want)
+		}
+	}
+}
+
+func TestPackageJSONWithoutVersion(t *testing.T) {
+	vf, err := parseVersionFile("packagejson", []byte(`{"engines":{"version":"1"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := vf.Versions(); len(got) != 0 {
+		t.Errorf("Versions() = %+v, want none", got)
+	}
+	if _, err := parseVersionFile("packagejson", []byte(`{"version": 2}`)); err == nil {
+		t.Error("a version which is not a string parsed")
+	}
+}
+
+func TestCheckVersionNames(t *testing.T) {
+	tests := []struct {
+		name string
+		repo repoConfig
+		ok   bool
+	}{
+		{"nothing to reset", repoConfig{}, true},
+		{"build only", repoConfig{BuildVersionName: "product"}, true},
+		{"build included", repoConfig{BuildVersionName: "product", ResetVersionNames: []string{"file", "product"}}, true},
+		{"build left out", repoConfig{BuildVersionName: "product", ResetVersionNames: []string{"file"}}, false},
+		{"no build name", repoConfig{ResetVersionNames: []string{"product"}}, false},
+	}
+
+	for _, tt := range tests {
+		if err := checkVersionNames(tt.repo); (err == nil) != tt.ok {
+			t.Errorf("%s: checkVersionNames = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}